@@ -1,21 +1,134 @@
 package backend
 
 import (
+	"context"
+	"io"
+	"log/slog"
+	"time"
+
 	"github.com/go-resty/resty/v2"
+	"github.com/nats-io/nats.go"
 	"github.com/redis/go-redis/v9"
 )
 
 type Config struct {
-	ConfigDir    string
-	RestyClient  *resty.Client
-	RedisClient  *redis.Client
-	Publisher    *Publisher
-	RawPublisher *RawPublisher
+	ConfigDir     string
+	RestyClient   *resty.Client
+	RedisClient   redis.UniversalClient
+	NATSClient    *nats.Conn
+	Store         MetricStore
+	RawSinks      *RawMux
+	StatusSinks   []StatusSink
+	MQTTPublisher *MQTTPublisher
+	NDJSONSink    *NDJSONSink
+
+	// Topic prefix for Home Assistant MQTT discovery; discovery is disabled
+	// if empty
+	HADiscoveryPrefix string
+}
+
+// StatusSink receives a copy of every status metric published to the store,
+// and is told when a status metric is removed
+type StatusSink interface {
+	PublishStatus(ctx context.Context, metric Metric) error
+	ClearStatus(ctx context.Context, name string) error
+}
+
+// PublishMetric publishes a status metric to the store and mirrors it to
+// the configured status sinks. Suppressed metrics are not mirrored and
+// return ErrMetricSuppressed.
+func (c *Config) PublishMetric(ctx context.Context, metric Metric) error {
+	if metric.UpdatedAt.IsZero() {
+		metric.UpdatedAt = time.Now()
+	}
+	if err := c.Store.Publish(ctx, metric); err != nil {
+		return err
+	}
+	for _, sink := range c.StatusSinks {
+		if err := sink.PublishStatus(ctx, metric); err != nil {
+			slog.Error("Error mirroring metric", "metric", metric.Name, "error", err)
+		}
+	}
+	return nil
+}
+
+// DeleteMetric removes a status metric from the store and clears it from
+// the configured status sinks
+func (c *Config) DeleteMetric(ctx context.Context, name string) error {
+	if err := c.Store.Delete(ctx, name); err != nil {
+		return err
+	}
+	c.clearStatus(ctx, name)
+	return nil
+}
+
+// ClearOverride removes an override from the store and clears it from the
+// configured status sinks
+func (c *Config) ClearOverride(ctx context.Context, name string) error {
+	if err := c.Store.ClearOverride(ctx, name); err != nil {
+		return err
+	}
+	c.clearStatus(ctx, name)
+	return nil
+}
+
+// Clear removed metrics from the status sinks
+func (c *Config) clearStatus(ctx context.Context, names ...string) {
+	for _, name := range names {
+		for _, sink := range c.StatusSinks {
+			if err := sink.ClearStatus(ctx, name); err != nil {
+				slog.Error("Error clearing metric", "metric", name, "error", err)
+			}
+		}
+	}
+}
+
+// Close drains and closes the raw metric sinks, if any, then closes the
+// status sinks and the NATS connection
+func (c *Config) Close() {
+	if c.RawSinks != nil {
+		c.RawSinks.Close()
+	}
+	for _, sink := range c.StatusSinks {
+		closer, ok := sink.(io.Closer)
+		if !ok {
+			continue
+		}
+		if err := closer.Close(); err != nil {
+			slog.Error("Error closing status sink", "error", err)
+		}
+	}
+	if c.NATSClient != nil {
+		c.NATSClient.Close()
+	}
 }
 
 type Range struct {
-	From     float64 `koanf:"from"`
-	To       float64 `koanf:"to"`
-	Priority int     `koanf:"priority"`
-	Colour   string  `koanf:"colour"`
+	From     float64   `koanf:"from"`
+	To       float64   `koanf:"to"`
+	Priority int       `koanf:"priority"`
+	Colour   string    `koanf:"colour"`
+	Schedule *Schedule `koanf:"schedule"`
+}
+
+// FindRange returns the first range containing value whose schedule, if
+// any, is active at now
+func FindRange(ranges []Range, value float64, now time.Time) (Range, bool) {
+	for _, metricRange := range ranges {
+		if value < metricRange.From || value >= metricRange.To {
+			continue
+		}
+		if metricRange.Schedule != nil {
+			active, err := metricRange.Schedule.Active(now)
+			if err != nil {
+				slog.Error("Invalid range schedule", "range", metricRange, "error", err)
+				continue
+			}
+			if !active {
+				continue
+			}
+		}
+		return metricRange, true
+	}
+	return Range{}, false
 }
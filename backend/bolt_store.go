@@ -0,0 +1,259 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	metricsBucket      = []byte("metrics")
+	suppressionsBucket = []byte("suppressions")
+)
+
+// BoltStore keeps metrics in a BoltDB file. The database is opened for
+// each operation so the collector and the CLI can share the same file.
+type BoltStore struct {
+	path string
+}
+
+// NewBoltStore creates a new BoltStore backed by the file at path
+func NewBoltStore(path string) *BoltStore {
+	return &BoltStore{
+		path: path,
+	}
+}
+
+// Run fn inside a transaction on the metrics bucket
+func (s *BoltStore) update(fn func(*bolt.Bucket) error) error {
+	return s.updateBucket(metricsBucket, fn)
+}
+
+// Run fn inside a transaction on the named bucket
+func (s *BoltStore) updateBucket(name []byte, fn func(*bolt.Bucket) error) error {
+	db, err := bolt.Open(s.path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(name)
+		if err != nil {
+			return err
+		}
+		return fn(bucket)
+	})
+}
+
+// Publish publishes the metric to the store
+func (s *BoltStore) Publish(ctx context.Context, metric Metric) error {
+	if err := checkSuppressed(ctx, s, metric); err != nil {
+		return err
+	}
+	data, err := json.Marshal(metric)
+	if err != nil {
+		return err
+	}
+	return s.update(func(b *bolt.Bucket) error {
+		if !metric.Override {
+			existing, err := readMetric(b, metric.Name)
+			if err != nil && !errors.Is(err, ErrMetricNotFound) {
+				return err
+			}
+			if err == nil && existing.Override {
+				return ErrMetricOverridden
+			}
+		}
+		return b.Put([]byte(metric.Name), data)
+	})
+}
+
+// Decode the named metric in the bucket
+func readMetric(b *bolt.Bucket, name string) (Metric, error) {
+	var metric Metric
+	data := b.Get([]byte(name))
+	if data == nil {
+		return metric, ErrMetricNotFound
+	}
+	err := json.Unmarshal(data, &metric)
+	return metric, err
+}
+
+// Load all metrics from the bucket keyed by name
+func (s *BoltStore) load() (map[string]Metric, error) {
+	var metrics map[string]Metric
+	err := s.update(func(b *bolt.Bucket) error {
+		var err error
+		metrics, err = readMetrics(b)
+		return err
+	})
+	return metrics, err
+}
+
+// Decode every metric in the bucket
+func readMetrics(b *bolt.Bucket) (map[string]Metric, error) {
+	metrics := make(map[string]Metric)
+	err := b.ForEach(func(k, v []byte) error {
+		var metric Metric
+		if err := json.Unmarshal(v, &metric); err != nil {
+			return err
+		}
+		metrics[string(k)] = metric
+		return nil
+	})
+	return metrics, err
+}
+
+// List metrics
+func (s *BoltStore) List(_ context.Context) ([]Metric, error) {
+	stored, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	metrics := make([]Metric, 0, len(stored))
+	for _, metric := range stored {
+		metrics = append(metrics, metric)
+	}
+	sortByPriority(metrics)
+	return metrics, nil
+}
+
+// Delete metric
+func (s *BoltStore) Delete(_ context.Context, name string) error {
+	return s.update(func(b *bolt.Bucket) error {
+		metric, err := readMetric(b, name)
+		if err != nil {
+			return err
+		}
+		if metric.Override {
+			return ErrMetricOverridden
+		}
+		return b.Delete([]byte(name))
+	})
+}
+
+// ClearOverride removes an override
+func (s *BoltStore) ClearOverride(_ context.Context, name string) error {
+	return s.update(func(b *bolt.Bucket) error {
+		metric, err := readMetric(b, name)
+		if err != nil {
+			return err
+		}
+		if !metric.Override {
+			return ErrNotOverride
+		}
+		return b.Delete([]byte(name))
+	})
+}
+
+// Cleanup removes metrics whose TTL has expired
+func (s *BoltStore) Cleanup(_ context.Context, dryRun bool) ([]string, error) {
+	// Find and remove expired metrics in the same transaction so that a
+	// metric republished in between is not lost
+	var expired []string
+	err := s.update(func(b *bolt.Bucket) error {
+		stored, err := readMetrics(b)
+		if err != nil {
+			return err
+		}
+
+		expired = expiredMetrics(stored, time.Now())
+		slog.Debug("Metrics to cleanup", "metrics", expired)
+		if dryRun {
+			slog.Info("Dry run, not removing metrics")
+			return nil
+		}
+
+		for _, name := range expired {
+			if err := b.Delete([]byte(name)); err != nil {
+				slog.Error("Failed to remove metric", "metric", name, "error", err)
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to cleanup metrics", "error", err)
+		return nil, err
+	}
+	if dryRun {
+		return expired, nil
+	}
+
+	// Drop expired suppressions
+	err = s.updateBucket(suppressionsBucket, func(b *bolt.Bucket) error {
+		suppressions, err := readSuppressions(b)
+		if err != nil {
+			return err
+		}
+		for _, suppression := range suppressions {
+			if suppression.Until.After(time.Now()) {
+				continue
+			}
+			if err := b.Delete([]byte(suppression.Pattern)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return expired, err
+}
+
+// Top returns the highest priority metric which is not suppressed
+func (s *BoltStore) Top(ctx context.Context) (*Metric, error) {
+	return topMetric(ctx, s)
+}
+
+// Suppress adds or replaces a suppression
+func (s *BoltStore) Suppress(_ context.Context, suppression Suppression) error {
+	data, err := json.Marshal(suppression)
+	if err != nil {
+		return err
+	}
+	return s.updateBucket(suppressionsBucket, func(b *bolt.Bucket) error {
+		return b.Put([]byte(suppression.Pattern), data)
+	})
+}
+
+// Decode every suppression in the bucket
+func readSuppressions(b *bolt.Bucket) ([]Suppression, error) {
+	suppressions := []Suppression{}
+	err := b.ForEach(func(k, v []byte) error {
+		var suppression Suppression
+		if err := json.Unmarshal(v, &suppression); err != nil {
+			return err
+		}
+		suppressions = append(suppressions, suppression)
+		return nil
+	})
+	return suppressions, err
+}
+
+// Suppressions returns the active suppressions
+func (s *BoltStore) Suppressions(_ context.Context) ([]Suppression, error) {
+	var suppressions []Suppression
+	err := s.updateBucket(suppressionsBucket, func(b *bolt.Bucket) error {
+		var err error
+		suppressions, err = readSuppressions(b)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return activeSuppressions(suppressions, time.Now()), nil
+}
+
+// Unsuppress removes a suppression
+func (s *BoltStore) Unsuppress(_ context.Context, pattern string) error {
+	return s.updateBucket(suppressionsBucket, func(b *bolt.Bucket) error {
+		if b.Get([]byte(pattern)) == nil {
+			return ErrSuppressionNotFound
+		}
+		return b.Delete([]byte(pattern))
+	})
+}
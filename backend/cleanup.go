@@ -9,11 +9,19 @@ import (
 	"github.com/redis/go-redis/v9"
 )
 
-// Pick metrics from the backend where the TTL has expired and remove them
-// from the priority and colour sets and the TTL sorted set itself.
+// CleanupMetrics removes expired metrics from the configured store and
+// clears them from the status sinks
 func CleanupMetrics(ctx context.Context, config *Config, dryRun bool) error {
-	p := config.Publisher
+	expired, err := config.Store.Cleanup(ctx, dryRun)
+	if !dryRun {
+		config.clearStatus(ctx, expired...)
+	}
+	return err
+}
 
+// Pick metrics from the backend where the TTL has expired and remove them
+// from the priority and colour sets and the TTL sorted set itself.
+func (p *Publisher) Cleanup(ctx context.Context, dryRun bool) ([]string, error) {
 	// Get the current timestamp
 	now := time.Now().Unix()
 
@@ -29,13 +37,13 @@ func CleanupMetrics(ctx context.Context, config *Config, dryRun bool) error {
 
 	if err != nil {
 		slog.Error("Failed to get metrics to cleanup", "error", err)
-		return err
+		return nil, err
 	}
 
 	slog.Debug("Metrics to cleanup", "metrics", metrics)
 	if dryRun {
 		slog.Info("Dry run, not removing metrics")
-		return nil
+		return metrics, nil
 	}
 
 	// Remove the metrics from the priority sorted set and colour hash map
@@ -43,20 +51,43 @@ func CleanupMetrics(ctx context.Context, config *Config, dryRun bool) error {
 		priority_key := p.prefix + ":priority"
 		if err := p.redisClient.ZRem(ctx, priority_key, metric).Err(); err != nil {
 			slog.Error("Failed to remove metric from priority", "metric", metric, "error", err)
-			return err
+			return nil, err
 		}
 
 		colour_key := p.prefix + ":colour"
 		if err := p.redisClient.HDel(ctx, colour_key, metric).Err(); err != nil {
 			slog.Error("Failed to remove metric from colour", "metric", metric, "error", err)
-			return err
+			return nil, err
 		}
 
 		if err := p.redisClient.ZRem(ctx, ttl_key, metric).Err(); err != nil {
 			slog.Error("Failed to remove metric from TTL", "metric", metric, "error", err)
-			return err
+			return nil, err
+		}
+
+		meta_key := p.prefix + ":meta"
+		if err := p.redisClient.HDel(ctx, meta_key, metric).Err(); err != nil {
+			slog.Error("Failed to remove metric metadata", "metric", metric, "error", err)
+			return nil, err
+		}
+	}
+
+	// Remove expired suppressions
+	suppressions, err := p.loadSuppressions(ctx)
+	if err != nil {
+		slog.Error("Failed to get suppressions to cleanup", "error", err)
+		return nil, err
+	}
+	suppressions_key := p.prefix + ":suppressions"
+	for _, suppression := range suppressions {
+		if suppression.Until.Unix() > now {
+			continue
+		}
+		if err := p.redisClient.HDel(ctx, suppressions_key, suppression.Pattern).Err(); err != nil {
+			slog.Error("Failed to remove suppression", "pattern", suppression.Pattern, "error", err)
+			return nil, err
 		}
 	}
 
-	return nil
+	return metrics, nil
 }
@@ -0,0 +1,251 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+const (
+	// Keep UDP datagrams below a typical MTU
+	influxUDPPayloadSize = 1400
+	// Upper bound on lines held back while InfluxDB is unreachable
+	influxMaxBuffered = 10000
+)
+
+// InfluxOptions configures the InfluxDB publisher
+type InfluxOptions struct {
+	URL           string // http(s)://host:8086 for the v2 write API, udp://host:8089 for UDP
+	Org           string
+	Bucket        string
+	Token         string
+	FlushInterval time.Duration
+	BatchSize     int
+	MaxRetries    int
+}
+
+// InfluxPublisher writes raw metrics to InfluxDB as line protocol. Lines are
+// batched and flushed every FlushInterval, or sooner once BatchSize lines
+// are pending.
+type InfluxPublisher struct {
+	mu      sync.Mutex
+	lines   []string
+	options InfluxOptions
+	write   func(ctx context.Context, lines []string) error
+	flushCh chan struct{}
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewInfluxPublisher creates a new InfluxPublisher and starts flushing in
+// the background until ctx is done
+func NewInfluxPublisher(ctx context.Context, options InfluxOptions) (*InfluxPublisher, error) {
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = 10 * time.Second
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = 500
+	}
+	if options.MaxRetries <= 0 {
+		options.MaxRetries = 3
+	}
+
+	u, err := url.Parse(options.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &InfluxPublisher{
+		options: options,
+		flushCh: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	switch u.Scheme {
+	case "http", "https":
+		p.write = newInfluxHTTPWriter(u, options)
+	case "udp":
+		conn, err := net.Dial("udp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		p.write = newInfluxUDPWriter(conn)
+	default:
+		return nil, fmt.Errorf("unsupported InfluxDB URL scheme: %s", u.Scheme)
+	}
+
+	ctx, p.cancel = context.WithCancel(ctx)
+	go p.run(ctx)
+	return p, nil
+}
+
+// Publish queues a raw metric for the next flush
+func (p *InfluxPublisher) Publish(_ context.Context, metric RawMetric) error {
+	line := influxLine(metric, time.Now())
+
+	p.mu.Lock()
+	p.lines = append(p.lines, line)
+	pending := len(p.lines)
+	p.mu.Unlock()
+
+	if pending >= p.options.BatchSize {
+		select {
+		case p.flushCh <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Close stops the background flusher after a final flush
+func (p *InfluxPublisher) Close() error {
+	p.cancel()
+	<-p.done
+	return nil
+}
+
+func (p *InfluxPublisher) run(ctx context.Context) {
+	defer close(p.done)
+	ticker := time.NewTicker(p.options.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Best effort flush of whatever is left
+			p.flush(context.Background())
+			return
+		case <-ticker.C:
+			p.flush(ctx)
+		case <-p.flushCh:
+			p.flush(ctx)
+		}
+	}
+}
+
+// Write pending lines, retrying with backoff. Lines which could not be
+// written are put back in front of the queue for the next flush.
+func (p *InfluxPublisher) flush(ctx context.Context) {
+	p.mu.Lock()
+	lines := p.lines
+	p.lines = nil
+	p.mu.Unlock()
+
+	if len(lines) == 0 {
+		return
+	}
+
+	backoff := time.Second
+	var err error
+retry:
+	for attempt := 1; attempt <= p.options.MaxRetries; attempt++ {
+		if err = p.write(ctx, lines); err == nil {
+			slog.Debug("Flushed metrics to InfluxDB", "lines", len(lines))
+			return
+		}
+		slog.Warn("Error writing to InfluxDB", "attempt", attempt, "error", err)
+		if attempt == p.options.MaxRetries {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			break retry
+		case <-time.After(backoff):
+			backoff *= 2
+		}
+	}
+
+	slog.Error("Giving up writing to InfluxDB until next flush", "lines", len(lines), "error", err)
+	p.mu.Lock()
+	p.lines = append(lines, p.lines...)
+	if dropped := len(p.lines) - influxMaxBuffered; dropped > 0 {
+		slog.Warn("Dropping buffered InfluxDB lines", "dropped", dropped)
+		p.lines = p.lines[dropped:]
+	}
+	p.mu.Unlock()
+}
+
+// Write lines using the InfluxDB v2 HTTP write API
+func newInfluxHTTPWriter(u *url.URL, options InfluxOptions) func(context.Context, []string) error {
+	client := resty.New().
+		SetTimeout(10*time.Second).
+		SetHeader("Content-Type", "text/plain; charset=utf-8")
+	if len(options.Token) > 0 {
+		client.SetHeader("Authorization", "Token "+options.Token)
+	}
+	writeURL := strings.TrimSuffix(u.String(), "/") + "/api/v2/write"
+
+	return func(ctx context.Context, lines []string) error {
+		resp, err := client.R().
+			SetContext(ctx).
+			SetQueryParams(map[string]string{
+				"org":       options.Org,
+				"bucket":    options.Bucket,
+				"precision": "ns",
+			}).
+			SetBody(strings.Join(lines, "\n")).
+			Post(writeURL)
+		if err != nil {
+			return err
+		}
+		if resp.IsError() {
+			return fmt.Errorf("error: %s %s", resp.Status(), string(resp.Body()))
+		}
+		return nil
+	}
+}
+
+// Write lines as UDP datagrams, packing as many lines per datagram as fit
+func newInfluxUDPWriter(conn net.Conn) func(context.Context, []string) error {
+	return func(_ context.Context, lines []string) error {
+		var datagram strings.Builder
+		send := func() error {
+			if datagram.Len() == 0 {
+				return nil
+			}
+			_, err := conn.Write([]byte(datagram.String()))
+			datagram.Reset()
+			return err
+		}
+		for _, line := range lines {
+			if datagram.Len()+len(line)+1 > influxUDPPayloadSize {
+				if err := send(); err != nil {
+					return err
+				}
+			}
+			datagram.WriteString(line)
+			datagram.WriteByte('\n')
+		}
+		return send()
+	}
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// Format a raw metric as a line protocol line
+func influxLine(metric RawMetric, ts time.Time) string {
+	var line strings.Builder
+	line.WriteString(influxMeasurementEscaper.Replace(metric.Name))
+	for _, tag := range [][2]string{
+		{"device_id", metric.DeviceID},
+		{"location", metric.Location},
+	} {
+		if len(tag[1]) == 0 {
+			continue
+		}
+		line.WriteString("," + tag[0] + "=" + influxTagEscaper.Replace(tag[1]))
+	}
+	line.WriteString(" value=" + strconv.FormatFloat(metric.Value, 'f', -1, 64))
+	line.WriteString(" " + strconv.FormatInt(ts.UnixNano(), 10))
+	return line.String()
+}
@@ -0,0 +1,307 @@
+package backend
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// KVStore keeps each metric as a JSON value in a NATS JetStream KV bucket.
+// Metric TTLs are carried in the value, as a bucket TTL would also expire
+// overrides. Expired metrics are treated as missing as soon as their TTL
+// passes, and are purged by Cleanup, which reports them to the status sinks.
+// Suppressions live in a second bucket named after the first with a
+// "-suppressions" suffix.
+type KVStore struct {
+	kv           nats.KeyValue
+	suppressions nats.KeyValue
+}
+
+// NewKVStore creates a new KVStore, creating the buckets if they do not exist
+func NewKVStore(natsClient *nats.Conn, bucket string) (*KVStore, error) {
+	js, err := natsClient.JetStream()
+	if err != nil {
+		return nil, err
+	}
+	kv, err := openKeyValue(js, bucket, "homemon metrics")
+	if err != nil {
+		return nil, err
+	}
+	suppressions, err := openKeyValue(js, bucket+"-suppressions", "homemon metric suppressions")
+	if err != nil {
+		return nil, err
+	}
+	return &KVStore{
+		kv:           kv,
+		suppressions: suppressions,
+	}, nil
+}
+
+// Open a KV bucket, creating it if it does not exist
+func openKeyValue(js nats.JetStreamContext, bucket string, description string) (nats.KeyValue, error) {
+	kv, err := js.KeyValue(bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      bucket,
+			Description: description,
+			History:     1,
+		})
+	}
+	return kv, err
+}
+
+// Metric names contain characters which are not valid in KV keys
+func kvKey(name string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+// Publish publishes the metric to the store
+func (s *KVStore) Publish(ctx context.Context, metric Metric) error {
+	if err := checkSuppressed(ctx, s, metric); err != nil {
+		return err
+	}
+	data, err := json.Marshal(metric)
+	if err != nil {
+		return err
+	}
+	key := kvKey(metric.Name)
+	for {
+		// Write against the revision checked, so that an override set in
+		// the meantime is not replaced
+		existing, revision, err := s.get(metric.Name)
+		switch {
+		case errors.Is(err, ErrMetricNotFound):
+			_, err = s.kv.Create(key, data)
+		case err != nil:
+			return err
+		case existing.Override && !metric.Override:
+			return ErrMetricOverridden
+		default:
+			_, err = s.kv.Update(key, data, revision)
+		}
+		if !errors.Is(err, nats.ErrKeyExists) {
+			return err
+		}
+		slog.Debug("Metric updated while publishing, retrying", "metric", metric.Name)
+	}
+}
+
+// Get the named metric from the bucket along with the revision of its
+// entry, including metrics which have expired
+func (s *KVStore) get(name string) (Metric, uint64, error) {
+	var metric Metric
+	entry, err := s.kv.Get(kvKey(name))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return metric, 0, ErrMetricNotFound
+	}
+	if err != nil {
+		return metric, 0, err
+	}
+	err = json.Unmarshal(entry.Value(), &metric)
+	return metric, entry.Revision(), err
+}
+
+// Get the named metric, treating it as missing if it has expired
+func (s *KVStore) getCurrent(name string) (Metric, error) {
+	metric, _, err := s.get(name)
+	if err != nil {
+		return metric, err
+	}
+	if len(expiredMetrics(map[string]Metric{name: metric}, time.Now())) > 0 {
+		return metric, ErrMetricNotFound
+	}
+	return metric, nil
+}
+
+// Purge the named metrics at the given revisions, so that a metric
+// republished in the meantime is kept, and return the names purged
+func (s *KVStore) purge(revisions map[string]uint64, names []string) ([]string, error) {
+	removed := []string{}
+	for _, name := range names {
+		err := s.kv.Purge(kvKey(name), nats.LastRevision(revisions[name]))
+		if errors.Is(err, nats.ErrKeyExists) {
+			slog.Debug("Metric updated since cleanup started", "metric", name)
+			continue
+		}
+		if err != nil {
+			slog.Error("Failed to remove metric", "metric", name, "error", err)
+			return removed, err
+		}
+		removed = append(removed, name)
+	}
+	return removed, nil
+}
+
+// Load all metrics from the bucket keyed by name, along with the revision
+// of each entry
+func (s *KVStore) load(ctx context.Context) (map[string]Metric, map[string]uint64, error) {
+	metrics := make(map[string]Metric)
+	revisions := make(map[string]uint64)
+	keys, err := s.kv.Keys(nats.Context(ctx))
+	if errors.Is(err, nats.ErrNoKeysFound) {
+		return metrics, revisions, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, key := range keys {
+		entry, err := s.kv.Get(key)
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			// Deleted since the keys were listed
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		var metric Metric
+		if err := json.Unmarshal(entry.Value(), &metric); err != nil {
+			return nil, nil, err
+		}
+		metrics[metric.Name] = metric
+		revisions[metric.Name] = entry.Revision()
+	}
+	return metrics, revisions, nil
+}
+
+// List metrics, leaving out the ones which have expired
+func (s *KVStore) List(ctx context.Context) ([]Metric, error) {
+	stored, _, err := s.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range expiredMetrics(stored, time.Now()) {
+		delete(stored, name)
+	}
+	metrics := make([]Metric, 0, len(stored))
+	for _, metric := range stored {
+		metrics = append(metrics, metric)
+	}
+	sortByPriority(metrics)
+	return metrics, nil
+}
+
+// Delete metric
+func (s *KVStore) Delete(_ context.Context, name string) error {
+	metric, err := s.getCurrent(name)
+	if err != nil {
+		return err
+	}
+	if metric.Override {
+		return ErrMetricOverridden
+	}
+	return s.kv.Delete(kvKey(name))
+}
+
+// ClearOverride removes an override
+func (s *KVStore) ClearOverride(_ context.Context, name string) error {
+	metric, _, err := s.get(name)
+	if err != nil {
+		return err
+	}
+	if !metric.Override {
+		return ErrNotOverride
+	}
+	return s.kv.Delete(kvKey(name))
+}
+
+// Cleanup removes metrics whose TTL has expired
+func (s *KVStore) Cleanup(ctx context.Context, dryRun bool) ([]string, error) {
+	stored, revisions, err := s.load(ctx)
+	if err != nil {
+		slog.Error("Failed to get metrics to cleanup", "error", err)
+		return nil, err
+	}
+	expired := expiredMetrics(stored, time.Now())
+	slog.Debug("Metrics to cleanup", "metrics", expired)
+	if dryRun {
+		slog.Info("Dry run, not removing metrics")
+		return expired, nil
+	}
+	removed, err := s.purge(revisions, expired)
+	if err != nil {
+		return removed, err
+	}
+
+	// Drop expired suppressions
+	suppressions, err := s.loadSuppressions(ctx)
+	if err != nil {
+		return removed, err
+	}
+	for _, suppression := range suppressions {
+		if suppression.Until.After(time.Now()) {
+			continue
+		}
+		if err := s.suppressions.Purge(kvKey(suppression.Pattern)); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// Top returns the highest priority metric which is not suppressed
+func (s *KVStore) Top(ctx context.Context) (*Metric, error) {
+	return topMetric(ctx, s)
+}
+
+// Suppress adds or replaces a suppression
+func (s *KVStore) Suppress(_ context.Context, suppression Suppression) error {
+	data, err := json.Marshal(suppression)
+	if err != nil {
+		return err
+	}
+	_, err = s.suppressions.Put(kvKey(suppression.Pattern), data)
+	return err
+}
+
+// Load every suppression, including expired ones
+func (s *KVStore) loadSuppressions(ctx context.Context) ([]Suppression, error) {
+	suppressions := []Suppression{}
+	keys, err := s.suppressions.Keys(nats.Context(ctx))
+	if errors.Is(err, nats.ErrNoKeysFound) {
+		return suppressions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		entry, err := s.suppressions.Get(key)
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var suppression Suppression
+		if err := json.Unmarshal(entry.Value(), &suppression); err != nil {
+			return nil, err
+		}
+		suppressions = append(suppressions, suppression)
+	}
+	return suppressions, nil
+}
+
+// Suppressions returns the active suppressions
+func (s *KVStore) Suppressions(ctx context.Context) ([]Suppression, error) {
+	suppressions, err := s.loadSuppressions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return activeSuppressions(suppressions, time.Now()), nil
+}
+
+// Unsuppress removes a suppression
+func (s *KVStore) Unsuppress(_ context.Context, pattern string) error {
+	key := kvKey(pattern)
+	if _, err := s.suppressions.Get(key); err != nil {
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			return ErrSuppressionNotFound
+		}
+		return err
+	}
+	return s.suppressions.Purge(key)
+}
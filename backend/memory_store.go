@@ -0,0 +1,159 @@
+package backend
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps metrics in memory. It is only visible to the process
+// that created it, so it suits tests and single-process setups.
+type MemoryStore struct {
+	mu           sync.Mutex
+	metrics      map[string]Metric
+	suppressions map[string]Suppression
+}
+
+// NewMemoryStore creates a new MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		metrics:      make(map[string]Metric),
+		suppressions: make(map[string]Suppression),
+	}
+}
+
+// Publish publishes the metric to the store
+func (s *MemoryStore) Publish(ctx context.Context, metric Metric) error {
+	if err := checkSuppressed(ctx, s, metric); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.metrics[metric.Name]; ok && existing.Override && !metric.Override {
+		return ErrMetricOverridden
+	}
+	s.metrics[metric.Name] = metric
+	return nil
+}
+
+// List metrics
+func (s *MemoryStore) List(_ context.Context) ([]Metric, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metrics := make([]Metric, 0, len(s.metrics))
+	for _, metric := range s.metrics {
+		metrics = append(metrics, metric)
+	}
+	sortByPriority(metrics)
+	return metrics, nil
+}
+
+// Delete metric
+func (s *MemoryStore) Delete(_ context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metric, ok := s.metrics[name]
+	if !ok {
+		return ErrMetricNotFound
+	}
+	if metric.Override {
+		return ErrMetricOverridden
+	}
+	delete(s.metrics, name)
+	return nil
+}
+
+// ClearOverride removes an override
+func (s *MemoryStore) ClearOverride(_ context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metric, ok := s.metrics[name]
+	if !ok {
+		return ErrMetricNotFound
+	}
+	if !metric.Override {
+		return ErrNotOverride
+	}
+	delete(s.metrics, name)
+	return nil
+}
+
+// Cleanup removes metrics whose TTL has expired
+func (s *MemoryStore) Cleanup(_ context.Context, dryRun bool) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expired := expiredMetrics(s.metrics, time.Now())
+	slog.Debug("Metrics to cleanup", "metrics", expired)
+	if dryRun {
+		slog.Info("Dry run, not removing metrics")
+		return expired, nil
+	}
+	for _, name := range expired {
+		delete(s.metrics, name)
+	}
+	for pattern, suppression := range s.suppressions {
+		if !suppression.Until.After(time.Now()) {
+			delete(s.suppressions, pattern)
+		}
+	}
+	return expired, nil
+}
+
+// Top returns the highest priority metric which is not suppressed
+func (s *MemoryStore) Top(ctx context.Context) (*Metric, error) {
+	return topMetric(ctx, s)
+}
+
+// Suppress adds or replaces a suppression
+func (s *MemoryStore) Suppress(_ context.Context, suppression Suppression) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.suppressions[suppression.Pattern] = suppression
+	return nil
+}
+
+// Suppressions returns the active suppressions
+func (s *MemoryStore) Suppressions(_ context.Context) ([]Suppression, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	suppressions := make([]Suppression, 0, len(s.suppressions))
+	for _, suppression := range s.suppressions {
+		suppressions = append(suppressions, suppression)
+	}
+	return activeSuppressions(suppressions, time.Now()), nil
+}
+
+// Unsuppress removes a suppression
+func (s *MemoryStore) Unsuppress(_ context.Context, pattern string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.suppressions[pattern]; !ok {
+		return ErrSuppressionNotFound
+	}
+	delete(s.suppressions, pattern)
+	return nil
+}
+
+// Sort metrics by priority in reverse order, breaking ties by name
+func sortByPriority(metrics []Metric) {
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].Priority != metrics[j].Priority {
+			return metrics[i].Priority > metrics[j].Priority
+		}
+		return metrics[i].Name > metrics[j].Name
+	})
+}
+
+// Names of metrics whose TTL is at or before now. Overrides do not expire.
+func expiredMetrics(metrics map[string]Metric, now time.Time) []string {
+	expired := []string{}
+	for name, metric := range metrics {
+		if !metric.Override && !metric.TTL.After(now) {
+			expired = append(expired, name)
+		}
+	}
+	sort.Strings(expired)
+	return expired
+}
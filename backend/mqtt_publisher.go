@@ -0,0 +1,157 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"text/template"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	DefaultMQTTRawTopic    = "homemon/{{.Location}}/{{.Name}}"
+	DefaultMQTTStatusTopic = "homemon/status/{{.Name}}"
+)
+
+// MQTTOptions configures the MQTT connection and topics
+type MQTTOptions struct {
+	BrokerURL   string
+	ClientID    string
+	Username    string
+	Password    string
+	QoS         byte
+	Retain      bool
+	RawTopic    string // Template rendered with a RawMetric
+	StatusTopic string // Template rendered with a Metric
+}
+
+// MQTTClient is the part of the paho MQTT client used by MQTTPublisher
+type MQTTClient interface {
+	Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token
+	Disconnect(quiesce uint)
+}
+
+// MQTTPublisher publishes raw and status metrics to an MQTT broker
+type MQTTPublisher struct {
+	client      MQTTClient
+	qos         byte
+	retain      bool
+	rawTopic    *template.Template
+	statusTopic *template.Template
+	closeOnce   sync.Once
+}
+
+// NewMQTTClient connects to the MQTT broker in options
+func NewMQTTClient(ctx context.Context, options MQTTOptions) (mqtt.Client, error) {
+	clientOptions := mqtt.NewClientOptions().
+		AddBroker(options.BrokerURL).
+		SetClientID(options.ClientID).
+		SetUsername(options.Username).
+		SetPassword(options.Password).
+		SetAutoReconnect(true).
+		SetConnectTimeout(10 * time.Second)
+
+	client := mqtt.NewClient(clientOptions)
+	if err := waitForToken(ctx, client.Connect()); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// NewMQTTPublisher creates a new MQTTPublisher using the given MQTT client
+func NewMQTTPublisher(client MQTTClient, options MQTTOptions) (*MQTTPublisher, error) {
+	if options.QoS > 2 {
+		return nil, fmt.Errorf("invalid MQTT QoS: %d", options.QoS)
+	}
+	if options.RawTopic == "" {
+		options.RawTopic = DefaultMQTTRawTopic
+	}
+	if options.StatusTopic == "" {
+		options.StatusTopic = DefaultMQTTStatusTopic
+	}
+	rawTopic, err := template.New("raw").Parse(options.RawTopic)
+	if err != nil {
+		return nil, err
+	}
+	statusTopic, err := template.New("status").Parse(options.StatusTopic)
+	if err != nil {
+		return nil, err
+	}
+	return &MQTTPublisher{
+		client:      client,
+		qos:         options.QoS,
+		retain:      options.Retain,
+		rawTopic:    rawTopic,
+		statusTopic: statusTopic,
+	}, nil
+}
+
+// Publish publishes a raw metric
+func (p *MQTTPublisher) Publish(ctx context.Context, metric RawMetric) error {
+	return p.publish(ctx, p.rawTopic, metric)
+}
+
+// PublishStatus publishes a status metric
+func (p *MQTTPublisher) PublishStatus(ctx context.Context, metric Metric) error {
+	return p.publish(ctx, p.statusTopic, metric)
+}
+
+// ClearStatus clears the retained status message of a removed metric by
+// publishing an empty retained payload to its topic
+func (p *MQTTPublisher) ClearStatus(ctx context.Context, name string) error {
+	var topic bytes.Buffer
+	if err := p.statusTopic.Execute(&topic, Metric{Name: name}); err != nil {
+		return err
+	}
+	return p.PublishMessage(ctx, topic.String(), []byte{}, true)
+}
+
+// PublishMessage publishes a payload to an arbitrary topic
+func (p *MQTTPublisher) PublishMessage(ctx context.Context, topic string, payload []byte, retain bool) error {
+	return waitForToken(ctx, p.client.Publish(topic, p.qos, retain, payload))
+}
+
+// Close disconnects from the broker once pending messages are sent. The
+// publisher is shared by the raw and status metrics, so closing it again
+// does nothing.
+func (p *MQTTPublisher) Close() error {
+	p.closeOnce.Do(func() {
+		p.client.Disconnect(250)
+	})
+	return nil
+}
+
+// RawTopic returns the topic a raw metric is published to
+func (p *MQTTPublisher) RawTopic(metric RawMetric) (string, error) {
+	var topic bytes.Buffer
+	if err := p.rawTopic.Execute(&topic, metric); err != nil {
+		return "", err
+	}
+	return topic.String(), nil
+}
+
+func (p *MQTTPublisher) publish(ctx context.Context, topicTemplate *template.Template, metric any) error {
+	var topic bytes.Buffer
+	if err := topicTemplate.Execute(&topic, metric); err != nil {
+		return err
+	}
+	data, err := json.Marshal(metric)
+	if err != nil {
+		return err
+	}
+	return p.PublishMessage(ctx, topic.String(), data, p.retain)
+}
+
+// Wait for an MQTT operation to complete or the context to be done
+func waitForToken(ctx context.Context, token mqtt.Token) error {
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
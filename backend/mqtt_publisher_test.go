@@ -0,0 +1,169 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Message published through fakeMQTTClient
+type fakeMessage struct {
+	topic    string
+	qos      byte
+	retained bool
+	payload  []byte
+}
+
+// fakeMQTTClient stands in for a broker connection and records what is
+// published
+type fakeMQTTClient struct {
+	messages    []fakeMessage
+	disconnects int
+}
+
+func (c *fakeMQTTClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	c.messages = append(c.messages, fakeMessage{
+		topic:    topic,
+		qos:      qos,
+		retained: retained,
+		payload:  payload.([]byte),
+	})
+	return &doneToken{done: closedChannel()}
+}
+
+func (c *fakeMQTTClient) Disconnect(_ uint) {
+	c.disconnects++
+}
+
+// doneToken is an MQTT token which has already completed
+type doneToken struct {
+	done chan struct{}
+}
+
+func (t *doneToken) Wait() bool                       { return true }
+func (t *doneToken) WaitTimeout(_ time.Duration) bool { return true }
+func (t *doneToken) Done() <-chan struct{}            { return t.done }
+func (t *doneToken) Error() error                     { return nil }
+
+func closedChannel() chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+func TestMQTTPublisherRawTopic(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{"default", "", "homemon/bedroom/temperature"},
+		{"custom", "home/{{.DeviceID}}/{{.Location}}/{{.Name}}", "home/netatmo/bedroom/temperature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeMQTTClient{}
+			publisher, err := NewMQTTPublisher(client, MQTTOptions{RawTopic: tt.template})
+			if err != nil {
+				t.Fatal(err)
+			}
+			metric := RawMetric{Name: "temperature", DeviceID: "netatmo", Location: "bedroom", Value: 21.5}
+			if err := publisher.Publish(context.Background(), metric); err != nil {
+				t.Fatal(err)
+			}
+			if len(client.messages) != 1 {
+				t.Fatalf("published %d messages, want 1", len(client.messages))
+			}
+			if got := client.messages[0].topic; got != tt.want {
+				t.Errorf("topic = %q, want %q", got, tt.want)
+			}
+			var got RawMetric
+			if err := json.Unmarshal(client.messages[0].payload, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != metric {
+				t.Errorf("payload = %+v, want %+v", got, metric)
+			}
+		})
+	}
+}
+
+func TestMQTTPublisherQoSAndRetain(t *testing.T) {
+	tests := []struct {
+		qos    byte
+		retain bool
+	}{
+		{0, false},
+		{1, true},
+		{2, false},
+	}
+	for _, tt := range tests {
+		client := &fakeMQTTClient{}
+		publisher, err := NewMQTTPublisher(client, MQTTOptions{QoS: tt.qos, Retain: tt.retain})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := publisher.PublishStatus(context.Background(), Metric{Name: "co2:bedroom"}); err != nil {
+			t.Fatal(err)
+		}
+		// Discovery payloads are always retained, at the configured QoS
+		if err := publisher.PublishMessage(context.Background(), "homeassistant/config", []byte("{}"), true); err != nil {
+			t.Fatal(err)
+		}
+		status, discovery := client.messages[0], client.messages[1]
+		if status.topic != "homemon/status/co2:bedroom" {
+			t.Errorf("status topic = %q", status.topic)
+		}
+		if status.qos != tt.qos || status.retained != tt.retain {
+			t.Errorf("status qos %d, retained %t, want qos %d, retained %t", status.qos, status.retained, tt.qos, tt.retain)
+		}
+		if discovery.qos != tt.qos || !discovery.retained {
+			t.Errorf("discovery qos %d, retained %t, want qos %d, retained", discovery.qos, discovery.retained, tt.qos)
+		}
+	}
+}
+
+func TestMQTTPublisherClearStatus(t *testing.T) {
+	client := &fakeMQTTClient{}
+	publisher, err := NewMQTTPublisher(client, MQTTOptions{StatusTopic: "home/{{.Name}}/state"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.ClearStatus(context.Background(), "co2:bedroom"); err != nil {
+		t.Fatal(err)
+	}
+	// An empty retained payload removes the retained status from the broker
+	cleared := client.messages[0]
+	if cleared.topic != "home/co2:bedroom/state" {
+		t.Errorf("cleared topic = %q", cleared.topic)
+	}
+	if !cleared.retained || len(cleared.payload) != 0 {
+		t.Errorf("cleared retained %t, payload %q, want an empty retained payload", cleared.retained, cleared.payload)
+	}
+}
+
+func TestMQTTPublisherInvalidOptions(t *testing.T) {
+	if _, err := NewMQTTPublisher(&fakeMQTTClient{}, MQTTOptions{QoS: 3}); err == nil {
+		t.Error("QoS 3 was accepted")
+	}
+	if _, err := NewMQTTPublisher(&fakeMQTTClient{}, MQTTOptions{RawTopic: "{{.Name"}); err == nil {
+		t.Error("invalid topic template was accepted")
+	}
+}
+
+func TestMQTTPublisherClose(t *testing.T) {
+	client := &fakeMQTTClient{}
+	publisher, err := NewMQTTPublisher(client, MQTTOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Closed as both a raw and a status sink
+	publisher.Close()
+	publisher.Close()
+	if client.disconnects != 1 {
+		t.Errorf("disconnected %d times, want 1", client.disconnects)
+	}
+}
@@ -0,0 +1,90 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// NDJSONRecord is a single line written by NDJSONSink
+type NDJSONRecord struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"` // "raw", "status" or "cleared"
+	Metric any       `json:"metric"`
+}
+
+// NDJSONSink writes raw and status metrics as line-delimited JSON
+type NDJSONSink struct {
+	mu     sync.Mutex
+	writer io.Writer
+	closer io.Closer // Set if the sink opened the writer itself
+	closed bool
+}
+
+// NewNDJSONSink creates a new NDJSONSink writing to writer, which is left
+// open when the sink is closed
+func NewNDJSONSink(writer io.Writer) *NDJSONSink {
+	return &NDJSONSink{
+		writer: writer,
+	}
+}
+
+// NewNDJSONFileSink creates a new NDJSONSink writing to a RotatingFile at
+// path, which is closed with the sink
+func NewNDJSONFileSink(path string, maxSize int64, maxAge time.Duration, compress bool) (*NDJSONSink, error) {
+	file, err := NewRotatingFile(path, maxSize, maxAge, compress)
+	if err != nil {
+		return nil, err
+	}
+	return &NDJSONSink{
+		writer: file,
+		closer: file,
+	}, nil
+}
+
+// Publish writes a raw metric
+func (s *NDJSONSink) Publish(_ context.Context, metric RawMetric) error {
+	return s.write("raw", metric)
+}
+
+// PublishStatus writes a status metric
+func (s *NDJSONSink) PublishStatus(_ context.Context, metric Metric) error {
+	return s.write("status", metric)
+}
+
+// ClearStatus writes a record noting that a status metric was removed
+func (s *NDJSONSink) ClearStatus(_ context.Context, name string) error {
+	return s.write("cleared", Metric{Name: name})
+}
+
+// Close closes the writer if the sink opened it. The sink is shared by the
+// raw and status metrics, so closing it again does nothing.
+func (s *NDJSONSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+	return nil
+}
+
+func (s *NDJSONSink) write(recordType string, metric any) error {
+	data, err := json.Marshal(NDJSONRecord{
+		Time:   time.Now(),
+		Type:   recordType,
+		Metric: metric,
+	})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.writer.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,372 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/knadh/koanf/parsers/yaml"
+	"github.com/knadh/koanf/providers/file"
+	"github.com/knadh/koanf/v2"
+)
+
+const (
+	NotifyConfigFile = "notify-config.yaml"
+
+	EventAlert    = "alert"
+	EventChanged  = "changed"
+	EventResolved = "resolved"
+)
+
+// NotifyConfig configures webhook notifications
+type NotifyConfig struct {
+	// Metrics at or above this priority are alerts
+	Threshold int `koanf:"threshold"`
+	// Minimum time between notifications for the same metric
+	RateLimit  time.Duration   `koanf:"rate-limit"`
+	QuietHours QuietHours      `koanf:"quiet-hours"`
+	Webhooks   []NotifyWebhook `koanf:"webhooks"`
+}
+
+// QuietHours suppresses notifications between From and To (HH:MM, local
+// time) unless the metric priority is at least MinPriority
+type QuietHours struct {
+	From        string `koanf:"from"`
+	To          string `koanf:"to"`
+	MinPriority int    `koanf:"min-priority"`
+}
+
+// NotifyWebhook is a notification endpoint
+type NotifyWebhook struct {
+	URL    string `koanf:"url"`
+	Format string `koanf:"format"` // json (default), ntfy, gotify or slack
+	Token  string `koanf:"token"`
+}
+
+// Notification is the payload posted by webhooks in the json format
+type Notification struct {
+	Event    string  `json:"event"`
+	Message  string  `json:"message"`
+	Metric   Metric  `json:"metric"`
+	Previous *Metric `json:"previous,omitempty"`
+}
+
+// LoadNotifyConfig loads the notification config file. It returns nil if
+// the file does not exist.
+func LoadNotifyConfig(path string) (*NotifyConfig, error) {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	k := koanf.New(".")
+	if err := k.Load(file.Provider(path), yaml.Parser()); err != nil {
+		return nil, err
+	}
+	notifyConfig := &NotifyConfig{}
+	if err := k.Unmarshal("", notifyConfig); err != nil {
+		return nil, err
+	}
+	if _, _, err := clockWindow(notifyConfig.QuietHours.From, notifyConfig.QuietHours.To); err != nil {
+		return nil, fmt.Errorf("invalid quiet-hours: %w", err)
+	}
+	return notifyConfig, nil
+}
+
+// NotifyingStore wraps a MetricStore and fires webhooks when a metric
+// crosses the priority threshold, changes colour while above it, or is
+// resolved by dropping back, expiring or being deleted. Notifications held
+// back by rate limiting or quiet hours stay pending and are sent on a later
+// publish or cleanup once they are allowed.
+type NotifyingStore struct {
+	MetricStore
+	config NotifyConfig
+	client *resty.Client
+
+	mu       sync.Mutex
+	seeded   bool
+	state    map[string]Metric
+	notified map[string]Metric // Alerts as last sent, until resolved
+	lastSent map[string]time.Time
+	sending  map[string]bool
+}
+
+// NewNotifyingStore creates a new NotifyingStore
+func NewNotifyingStore(store MetricStore, config NotifyConfig) *NotifyingStore {
+	return &NotifyingStore{
+		MetricStore: store,
+		config:      config,
+		client:      resty.New().SetTimeout(10 * time.Second),
+		state:       make(map[string]Metric),
+		notified:    make(map[string]Metric),
+		lastSent:    make(map[string]time.Time),
+		sending:     make(map[string]bool),
+	}
+}
+
+// Load the current metrics so that changes are detected across restarts.
+// Alerts which already exist are taken to have been sent. Must be called
+// with the lock held.
+func (s *NotifyingStore) seed(ctx context.Context) {
+	if s.seeded {
+		return
+	}
+	metrics, err := s.MetricStore.List(ctx)
+	if err != nil {
+		slog.Warn("Unable to load metrics for notifications", "error", err)
+		return
+	}
+	for _, metric := range metrics {
+		s.state[metric.Name] = metric
+		if s.isAlert(metric) {
+			s.notified[metric.Name] = metric
+		}
+	}
+	s.seeded = true
+}
+
+func (s *NotifyingStore) isAlert(metric Metric) bool {
+	return metric.Priority >= s.config.Threshold
+}
+
+// Publish publishes the metric and notifies on threshold and colour changes
+func (s *NotifyingStore) Publish(ctx context.Context, metric Metric) error {
+	s.mu.Lock()
+	s.seed(ctx)
+	if err := s.MetricStore.Publish(ctx, metric); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.state[metric.Name] = metric
+	notifications := s.due(time.Now(), metric.Name)
+	s.mu.Unlock()
+
+	s.deliver(ctx, notifications)
+	return nil
+}
+
+// Delete deletes the metric and resolves it if it was an alert
+func (s *NotifyingStore) Delete(ctx context.Context, name string) error {
+	s.mu.Lock()
+	s.seed(ctx)
+	if err := s.MetricStore.Delete(ctx, name); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	delete(s.state, name)
+	notifications := s.due(time.Now(), name)
+	s.mu.Unlock()
+
+	s.deliver(ctx, notifications)
+	return nil
+}
+
+// ClearOverride clears the override and resolves it if it was an alert
+func (s *NotifyingStore) ClearOverride(ctx context.Context, name string) error {
+	s.mu.Lock()
+	s.seed(ctx)
+	if err := s.MetricStore.ClearOverride(ctx, name); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	delete(s.state, name)
+	notifications := s.due(time.Now(), name)
+	s.mu.Unlock()
+
+	s.deliver(ctx, notifications)
+	return nil
+}
+
+// Cleanup removes expired metrics and resolves the ones which were alerts.
+// It also sends the notifications which are no longer held back.
+func (s *NotifyingStore) Cleanup(ctx context.Context, dryRun bool) ([]string, error) {
+	s.mu.Lock()
+	s.seed(ctx)
+	expired, err := s.MetricStore.Cleanup(ctx, dryRun)
+	if err != nil || dryRun {
+		s.mu.Unlock()
+		return expired, err
+	}
+	// Metrics removed from the store by another process are resolved once
+	// their TTL runs out
+	now := time.Now()
+	for _, name := range append(expired, expiredMetrics(s.state, now)...) {
+		delete(s.state, name)
+	}
+	names := make([]string, 0, len(s.state)+len(s.notified))
+	for name := range s.state {
+		names = append(names, name)
+	}
+	for name := range s.notified {
+		if _, ok := s.state[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	notifications := s.due(now, names...)
+	s.mu.Unlock()
+
+	s.deliver(ctx, notifications)
+	return expired, nil
+}
+
+// Notifications which are due for the named metrics, comparing each metric
+// with the alert last sent for it. Notifications held back by rate limiting
+// or quiet hours are left for a later call. Must be called with the lock
+// held.
+func (s *NotifyingStore) due(now time.Time, names ...string) []Notification {
+	var notifications []Notification
+	for _, name := range names {
+		if s.sending[name] {
+			// Compared again once the notification in flight is done
+			continue
+		}
+		current, exists := s.state[name]
+		last, notified := s.notified[name]
+		alert := exists && s.isAlert(current)
+
+		var notification Notification
+		switch {
+		case alert && !notified:
+			notification = Notification{Event: EventAlert, Metric: current}
+		case alert && last.Colour != current.Colour:
+			notification = Notification{Event: EventChanged, Metric: current, Previous: &last}
+		case !alert && notified:
+			notification = Notification{Event: EventResolved, Metric: last, Previous: &last}
+			if exists {
+				notification.Metric = current
+			}
+		default:
+			continue
+		}
+		event, metric := notification.Event, notification.Metric
+
+		if sentAt, ok := s.lastSent[name]; ok && event != EventResolved && now.Sub(sentAt) < s.config.RateLimit {
+			slog.Debug("Notification rate limited", "metric", name, "event", event)
+			continue
+		}
+		if s.config.QuietHours.contains(now) &&
+			(s.config.QuietHours.MinPriority == 0 || metric.Priority < s.config.QuietHours.MinPriority) {
+			slog.Debug("Notification held back during quiet hours", "metric", name, "event", event)
+			continue
+		}
+
+		notification.Message = notificationMessage(event, metric)
+		s.sending[name] = true
+		notifications = append(notifications, notification)
+	}
+	return notifications
+}
+
+// Send notifications to every webhook without holding the lock. A
+// notification only counts as sent if at least one webhook accepted it;
+// otherwise it is tried again on a later publish or cleanup.
+func (s *NotifyingStore) deliver(ctx context.Context, notifications []Notification) {
+	for _, notification := range notifications {
+		name := notification.Metric.Name
+		sent := false
+		for _, webhook := range s.config.Webhooks {
+			if err := s.send(ctx, webhook, notification); err != nil {
+				slog.Error("Error sending notification", "url", webhook.URL, "event", notification.Event, "metric", name, "error", err)
+				continue
+			}
+			sent = true
+		}
+
+		s.mu.Lock()
+		delete(s.sending, name)
+		if sent {
+			s.lastSent[name] = time.Now()
+			if notification.Event == EventResolved {
+				delete(s.notified, name)
+			} else {
+				s.notified[name] = notification.Metric
+			}
+		}
+		s.mu.Unlock()
+
+		if sent {
+			slog.Info("Sent notification", "event", notification.Event, "metric", name)
+		}
+	}
+}
+
+func notificationMessage(event string, metric Metric) string {
+	if event == EventResolved {
+		return fmt.Sprintf("%s resolved", metric.Name)
+	}
+	if metric.Message != "" {
+		return fmt.Sprintf("%s is %s (priority %d): %s", metric.Name, metric.Colour, metric.Priority, metric.Message)
+	}
+	return fmt.Sprintf("%s is %s (priority %d)", metric.Name, metric.Colour, metric.Priority)
+}
+
+// Post a notification in the webhook's format
+func (s *NotifyingStore) send(ctx context.Context, webhook NotifyWebhook, notification Notification) error {
+	req := s.client.R().SetContext(ctx)
+	title := "homemon: " + notification.Metric.Name
+
+	switch webhook.Format {
+	case "", "json":
+		req.SetHeader("Content-Type", "application/json").SetBody(notification)
+	case "ntfy":
+		// https://docs.ntfy.sh/publish/
+		req.SetHeader("Title", title).
+			SetHeader("Priority", strconv.Itoa(ntfyPriority(notification))).
+			SetHeader("Tags", notification.Metric.Colour).
+			SetBody(notification.Message)
+		if len(webhook.Token) > 0 {
+			req.SetAuthToken(webhook.Token)
+		}
+	case "gotify":
+		// https://gotify.net/api-docs#/message/createMessage
+		req.SetHeader("Content-Type", "application/json").
+			SetHeader("X-Gotify-Key", webhook.Token).
+			SetBody(map[string]any{
+				"title":    title,
+				"message":  notification.Message,
+				"priority": ntfyPriority(notification) * 2,
+			})
+	case "slack":
+		req.SetHeader("Content-Type", "application/json").
+			SetBody(map[string]string{
+				"text": notification.Message,
+			})
+	default:
+		return fmt.Errorf("unknown webhook format: %s", webhook.Format)
+	}
+
+	resp, err := req.Post(webhook.URL)
+	if err != nil {
+		return err
+	}
+	if resp.IsError() {
+		return fmt.Errorf("error: %s %s", resp.Status(), string(resp.Body()))
+	}
+	return nil
+}
+
+// Map metric priority (0-100) to the ntfy priority scale (1-5)
+func ntfyPriority(notification Notification) int {
+	if notification.Event == EventResolved {
+		return 2
+	}
+	priority := notification.Metric.Priority/20 + 1
+	return min(max(priority, 1), 5)
+}
+
+// Whether t falls in the quiet hours window, which may span midnight
+func (q QuietHours) contains(t time.Time) bool {
+	from, to, err := clockWindow(q.From, q.To)
+	if err != nil || from == to {
+		return false
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if from < to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to
+}
@@ -0,0 +1,59 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// ErrNotOverride is returned when clearing a metric which is not an override
+var ErrNotOverride = errors.New("metric is not an override")
+
+// ErrMetricOverridden is returned when publishing or deleting a metric which
+// would replace or remove an override, as only clearing the override may
+var ErrMetricOverridden = errors.New("metric is overridden")
+
+// OverrideActive reports whether the metric is an override in effect at now
+func (m Metric) OverrideActive(now time.Time) bool {
+	if !m.Override {
+		return false
+	}
+	if m.Schedule == nil {
+		return true
+	}
+	active, err := m.Schedule.Active(now)
+	if err != nil {
+		slog.Warn("Invalid override schedule", "metric", m.Name, "error", err)
+		return false
+	}
+	return active
+}
+
+// Return the active override with the highest priority, or failing that
+// the highest priority metric which is neither an override nor suppressed
+func topMetric(ctx context.Context, store MetricStore) (*Metric, error) {
+	metrics, err := store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, metric := range metrics {
+		if metric.OverrideActive(now) {
+			return &metric, nil
+		}
+	}
+	suppressions, err := store.Suppressions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, metric := range metrics {
+		if metric.Override {
+			continue
+		}
+		if _, ok := FindSuppression(suppressions, metric, now); !ok {
+			return &metric, nil
+		}
+	}
+	return nil, nil
+}
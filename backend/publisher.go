@@ -2,17 +2,27 @@ package backend
 
 import (
 	"context"
-	"log"
+	"encoding/json"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
 type Metric struct {
-	Name     string
-	Priority int
-	Colour   string
-	TTL      time.Time
+	Name     string    `json:"name"`
+	Priority int       `json:"priority"`
+	Colour   string    `json:"colour"`
+	TTL      time.Time `json:"ttl"`
+	// Reading which triggered the metric, if any
+	Value     *float64  `json:"value,omitempty"`
+	Unit      string    `json:"unit,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	Source    string    `json:"source,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Overrides win over all other metrics until they are cleared, while
+	// their schedule, if any, is active. They have no TTL.
+	Override bool      `json:"override,omitempty"`
+	Schedule *Schedule `json:"schedule,omitempty"`
 }
 
 // Metric generator closure
@@ -27,17 +37,16 @@ func MetricGenerator(name string, ttl time.Duration) func(int, string) Metric {
 	}
 }
 
-// Publish publishes the data to the backend
+// Publisher is a MetricStore which keeps metrics in redis
 type Publisher struct {
-	redisClient *redis.Client
+	redisClient redis.UniversalClient
 	prefix      string
 }
 
-// NewPublisher creates a new Publisher
-func NewPublisher(address, prefix string) *Publisher {
-	redisClient := redis.NewClient(&redis.Options{
-		Addr: address,
-	})
+// NewPublisher creates a new Publisher using the given redis client. Any
+// redis.UniversalClient works here, so standalone, cluster and failover
+// clients can all be shared with the rest of the process.
+func NewPublisher(redisClient redis.UniversalClient, prefix string) *Publisher {
 	return &Publisher{
 		redisClient: redisClient,
 		prefix:      prefix,
@@ -46,6 +55,20 @@ func NewPublisher(address, prefix string) *Publisher {
 
 // Publish publishes the data to the backend
 func (p *Publisher) Publish(ctx context.Context, metric Metric) error {
+	override_key := p.prefix + ":override"
+	if !metric.Override {
+		overridden, err := p.redisClient.HExists(ctx, override_key, metric.Name).Result()
+		if err != nil {
+			return err
+		}
+		if overridden {
+			return ErrMetricOverridden
+		}
+	}
+	if err := checkSuppressed(ctx, p, metric); err != nil {
+		return err
+	}
+
 	// Push priority to a sorted set
 	priority_key := p.prefix + ":priority"
 	if err := p.redisClient.ZAdd(ctx, priority_key, redis.Z{Score: float64(metric.Priority), Member: metric.Name}).Err(); err != nil {
@@ -58,8 +81,38 @@ func (p *Publisher) Publish(ctx context.Context, metric Metric) error {
 		return err
 	}
 
-	// Push TTL to a sorted set
+	// Push the metadata to a hash as JSON, leaving the existing keys as
+	// they were for older readers
+	meta_key := p.prefix + ":meta"
+	data, err := json.Marshal(metricMeta{
+		Value:     metric.Value,
+		Unit:      metric.Unit,
+		Message:   metric.Message,
+		Source:    metric.Source,
+		UpdatedAt: metric.UpdatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	if err := p.redisClient.HSet(ctx, meta_key, metric.Name, data).Err(); err != nil {
+		return err
+	}
+
+	// Overrides keep their schedule in a hash and have no TTL, so cleanup
+	// leaves them alone
 	ttl_key := p.prefix + ":ttl"
+	if metric.Override {
+		data, err := json.Marshal(overrideFields{Schedule: metric.Schedule})
+		if err != nil {
+			return err
+		}
+		if err := p.redisClient.HSet(ctx, override_key, metric.Name, data).Err(); err != nil {
+			return err
+		}
+		return p.redisClient.ZRem(ctx, ttl_key, metric.Name).Err()
+	}
+
+	// Push TTL to a sorted set
 	if err := p.redisClient.ZAdd(ctx, ttl_key, redis.Z{Score: float64(metric.TTL.Unix()), Member: metric.Name}).Err(); err != nil {
 		return err
 	}
@@ -67,14 +120,40 @@ func (p *Publisher) Publish(ctx context.Context, metric Metric) error {
 	return nil
 }
 
+// Fields of a metric kept in the meta hash. Metrics published by older
+// versions have no entry.
+type metricMeta struct {
+	Value     *float64  `json:"value,omitempty"`
+	Unit      string    `json:"unit,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	Source    string    `json:"source,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Fields of an override kept in the override hash
+type overrideFields struct {
+	Schedule *Schedule `json:"schedule,omitempty"`
+}
+
 // List metrics
-func (p *Publisher) ListMetrics(ctx context.Context, config *Config) ([]Metric, error) {
+func (p *Publisher) List(ctx context.Context) ([]Metric, error) {
 	// Get all metrics
 	priority_key := p.prefix + ":priority"
 	colour_key := p.prefix + ":colour"
 	ttl_key := p.prefix + ":ttl"
+	override_key := p.prefix + ":override"
+	meta_key := p.prefix + ":meta"
 	metrics := []Metric{}
 
+	overrides, err := p.redisClient.HGetAll(ctx, override_key).Result()
+	if err != nil {
+		return nil, err
+	}
+	metas, err := p.redisClient.HGetAll(ctx, meta_key).Result()
+	if err != nil {
+		return nil, err
+	}
+
 	// Get all members with scores ordered by priority in reverse order
 	members, err := p.redisClient.ZRevRangeByScoreWithScores(ctx, priority_key, &redis.ZRangeBy{
 		Min: "-inf",
@@ -89,31 +168,85 @@ func (p *Publisher) ListMetrics(ctx context.Context, config *Config) ([]Metric,
 			return nil, err
 		}
 		priority := int(member.Score)
-		ttl, err := p.redisClient.ZScore(ctx, ttl_key, member.Member.(string)).Result()
-		if err != nil {
-			return nil, err
-		}
-		metrics = append(metrics, Metric{
+		metric := Metric{
 			Name:     member.Member.(string),
 			Priority: priority,
 			Colour:   colour,
-			TTL:      time.Unix(int64(ttl), 0),
-		})
+		}
+		if data, ok := metas[metric.Name]; ok {
+			var meta metricMeta
+			if err := json.Unmarshal([]byte(data), &meta); err != nil {
+				return nil, err
+			}
+			metric.Value = meta.Value
+			metric.Unit = meta.Unit
+			metric.Message = meta.Message
+			metric.Source = meta.Source
+			metric.UpdatedAt = meta.UpdatedAt
+		}
+		if data, ok := overrides[metric.Name]; ok {
+			var fields overrideFields
+			if err := json.Unmarshal([]byte(data), &fields); err != nil {
+				return nil, err
+			}
+			metric.Override = true
+			metric.Schedule = fields.Schedule
+			metrics = append(metrics, metric)
+			continue
+		}
+		ttl, err := p.redisClient.ZScore(ctx, ttl_key, metric.Name).Result()
+		if err != nil {
+			return nil, err
+		}
+		metric.TTL = time.Unix(int64(ttl), 0)
+		metrics = append(metrics, metric)
 	}
 
 	return metrics, nil
 }
 
 // Delete metric
-func (p *Publisher) DeleteMetric(ctx context.Context, name string) error {
-	// Ensure metric exists
+func (p *Publisher) Delete(ctx context.Context, name string) error {
+	override, err := p.isOverride(ctx, name)
+	if err != nil {
+		return err
+	}
+	if override {
+		return ErrMetricOverridden
+	}
+	return p.remove(ctx, name)
+}
+
+// ClearOverride removes an override
+func (p *Publisher) ClearOverride(ctx context.Context, name string) error {
+	override, err := p.isOverride(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !override {
+		return ErrNotOverride
+	}
+	return p.remove(ctx, name)
+}
+
+// Report whether the named metric is an override, or ErrMetricNotFound if
+// it does not exist
+func (p *Publisher) isOverride(ctx context.Context, name string) (bool, error) {
 	priority_key := p.prefix + ":priority"
 	if _, err := p.redisClient.ZRank(ctx, priority_key, name).Result(); err != nil {
-		// Metric does not exist
-		log.Fatalf("Metric %s does not exist", name)
+		if err == redis.Nil {
+			return false, ErrMetricNotFound
+		}
+		return false, err
 	}
+	override_key := p.prefix + ":override"
+	return p.redisClient.HExists(ctx, override_key, name).Result()
+}
 
+// Remove every key of a metric
+func (p *Publisher) remove(ctx context.Context, name string) error {
 	// Delete priority
+	priority_key := p.prefix + ":priority"
 	if err := p.redisClient.ZRem(ctx, priority_key, name).Err(); err != nil {
 		return err
 	}
@@ -130,5 +263,72 @@ func (p *Publisher) DeleteMetric(ctx context.Context, name string) error {
 		return err
 	}
 
+	// Delete override
+	override_key := p.prefix + ":override"
+	if err := p.redisClient.HDel(ctx, override_key, name).Err(); err != nil {
+		return err
+	}
+
+	// Delete metadata
+	meta_key := p.prefix + ":meta"
+	if err := p.redisClient.HDel(ctx, meta_key, name).Err(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Top returns the highest priority metric which is not suppressed
+func (p *Publisher) Top(ctx context.Context) (*Metric, error) {
+	return topMetric(ctx, p)
+}
+
+// Suppress adds or replaces a suppression
+func (p *Publisher) Suppress(ctx context.Context, suppression Suppression) error {
+	data, err := json.Marshal(suppression)
+	if err != nil {
+		return err
+	}
+	suppressions_key := p.prefix + ":suppressions"
+	return p.redisClient.HSet(ctx, suppressions_key, suppression.Pattern, data).Err()
+}
+
+// Load every suppression, including expired ones
+func (p *Publisher) loadSuppressions(ctx context.Context) ([]Suppression, error) {
+	suppressions_key := p.prefix + ":suppressions"
+	values, err := p.redisClient.HGetAll(ctx, suppressions_key).Result()
+	if err != nil {
+		return nil, err
+	}
+	suppressions := []Suppression{}
+	for _, value := range values {
+		var suppression Suppression
+		if err := json.Unmarshal([]byte(value), &suppression); err != nil {
+			return nil, err
+		}
+		suppressions = append(suppressions, suppression)
+	}
+	return suppressions, nil
+}
+
+// Suppressions returns the active suppressions
+func (p *Publisher) Suppressions(ctx context.Context) ([]Suppression, error) {
+	suppressions, err := p.loadSuppressions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return activeSuppressions(suppressions, time.Now()), nil
+}
+
+// Unsuppress removes a suppression
+func (p *Publisher) Unsuppress(ctx context.Context, pattern string) error {
+	suppressions_key := p.prefix + ":suppressions"
+	removed, err := p.redisClient.HDel(ctx, suppressions_key, pattern).Result()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return ErrSuppressionNotFound
+	}
 	return nil
 }
@@ -3,6 +3,7 @@ package backend
 import (
 	"context"
 	"encoding/json"
+	"time"
 
 	"github.com/nats-io/nats.go"
 )
@@ -20,19 +21,21 @@ type RawPublisher struct {
 	natsPrefix string
 }
 
-// NewNATSPublisher creates a new NATSPublisher
-func NewNATSPublisher(address string, prefix string) (*RawPublisher, error) {
-	natsClient, err := nats.Connect(address)
-	if err != nil {
-		return nil, err
-	}
+// NewNATSPublisher creates a new NATSPublisher using the given NATS connection
+func NewNATSPublisher(natsClient *nats.Conn, prefix string) *RawPublisher {
 	if len(prefix) > 0 {
 		prefix += "."
 	}
 	return &RawPublisher{
 		natsClient: natsClient,
 		natsPrefix: prefix,
-	}, nil
+	}
+}
+
+// Close flushes the metrics buffered by the NATS connection. The connection
+// itself is shared, so it is left open.
+func (p *RawPublisher) Close() error {
+	return p.natsClient.FlushTimeout(5 * time.Second)
 }
 
 // Publish publishes the data to the backend
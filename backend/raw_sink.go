@@ -0,0 +1,135 @@
+package backend
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+// RawSink receives raw metrics
+type RawSink interface {
+	Publish(ctx context.Context, metric RawMetric) error
+}
+
+// RawSinkStats reports the health of a sink attached to a RawMux
+type RawSinkStats struct {
+	Name      string
+	Published int64
+	Errors    int64
+	Dropped   int64
+}
+
+// RawMux fans raw metrics out to any number of sinks. Every sink gets its
+// own buffer and goroutine, so a slow or failing sink only drops its own
+// metrics and never blocks the caller.
+type RawMux struct {
+	ctx        context.Context
+	bufferSize int
+	sinks      []*muxSink
+	wg         sync.WaitGroup
+}
+
+type muxSink struct {
+	name      string
+	sink      RawSink
+	queue     chan RawMetric
+	published atomic.Int64
+	errors    atomic.Int64
+	dropped   atomic.Int64
+}
+
+// NewRawMux creates a new RawMux whose sinks run until ctx is done
+func NewRawMux(ctx context.Context, bufferSize int) *RawMux {
+	return &RawMux{
+		ctx:        ctx,
+		bufferSize: bufferSize,
+	}
+}
+
+// Add attaches a sink. Sinks must be added before the first Publish.
+func (m *RawMux) Add(name string, sink RawSink) {
+	s := &muxSink{
+		name:  name,
+		sink:  sink,
+		queue: make(chan RawMetric, m.bufferSize),
+	}
+	m.sinks = append(m.sinks, s)
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		s.run(m.ctx)
+	}()
+}
+
+// Len returns the number of attached sinks
+func (m *RawMux) Len() int {
+	return len(m.sinks)
+}
+
+// Publish queues the metric for every sink. Metrics are dropped for sinks
+// whose buffer is full.
+func (m *RawMux) Publish(_ context.Context, metric RawMetric) error {
+	for _, s := range m.sinks {
+		select {
+		case s.queue <- metric:
+		default:
+			dropped := s.dropped.Add(1)
+			slog.Warn("Raw sink buffer full, dropping metric", "sink", s.name, "metric", metric.Name, "dropped", dropped)
+		}
+	}
+	return nil
+}
+
+// Stats returns per-sink counters
+func (m *RawMux) Stats() []RawSinkStats {
+	stats := make([]RawSinkStats, 0, len(m.sinks))
+	for _, s := range m.sinks {
+		stats = append(stats, RawSinkStats{
+			Name:      s.name,
+			Published: s.published.Load(),
+			Errors:    s.errors.Load(),
+			Dropped:   s.dropped.Load(),
+		})
+	}
+	return stats
+}
+
+// Close stops accepting metrics, waits for the sinks to drain their
+// buffers and then closes the sinks which can be closed
+func (m *RawMux) Close() {
+	for _, s := range m.sinks {
+		close(s.queue)
+	}
+	m.wg.Wait()
+	for _, s := range m.sinks {
+		closer, ok := s.sink.(io.Closer)
+		if !ok {
+			continue
+		}
+		if err := closer.Close(); err != nil {
+			slog.Error("Error closing raw sink", "sink", s.name, "error", err)
+		}
+	}
+}
+
+func (s *muxSink) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case metric, ok := <-s.queue:
+			if !ok {
+				return
+			}
+			if err := s.sink.Publish(ctx, metric); err != nil {
+				count := s.errors.Add(1)
+				slog.Error("Error publishing raw metric", "sink", s.name, "metric", metric.Name, "errors", count, "error", err)
+				continue
+			}
+			s.published.Add(1)
+		}
+	}
+}
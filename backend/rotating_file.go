@@ -0,0 +1,140 @@
+package backend
+
+import (
+	"compress/gzip"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// RotatingFile is an append-only file which is rotated once it grows past
+// maxSize bytes or is older than maxAge. Rotated segments are renamed with
+// a timestamp suffix and optionally gzipped.
+type RotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxAge   time.Duration
+	compress bool
+	file     *os.File
+	size     int64
+	started  time.Time // When the current segment was started
+}
+
+// NewRotatingFile opens path for appending. A zero maxSize or maxAge
+// disables the corresponding rotation trigger.
+func NewRotatingFile(path string, maxSize int64, maxAge time.Duration, compress bool) (*RotatingFile, error) {
+	f := &RotatingFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxAge:   maxAge,
+		compress: compress,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	// An existing segment is aged from its last write, so restarts don't
+	// keep it from rotating
+	f.started = time.Now()
+	if f.size > 0 {
+		f.started = info.ModTime()
+	}
+	return nil
+}
+
+// Write appends p to the file, rotating first if needed
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.size > 0 && f.needsRotation(int64(len(p))) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes the current segment
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+func (f *RotatingFile) needsRotation(incoming int64) bool {
+	if f.maxSize > 0 && f.size+incoming > f.maxSize {
+		return true
+	}
+	return f.maxAge > 0 && time.Since(f.started) > f.maxAge
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	segment := f.path + "." + time.Now().Format("20060102T150405.000")
+	if err := os.Rename(f.path, segment); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	if f.compress {
+		compressSegment(segment)
+	}
+	return nil
+}
+
+// Gzip a rotated segment and remove the uncompressed copy
+func compressSegment(segment string) {
+	if err := gzipFile(segment); err != nil {
+		slog.Error("Error compressing rotated file", "file", segment, "error", err)
+		return
+	}
+	if err := os.Remove(segment); err != nil {
+		slog.Error("Error removing rotated file", "file", segment, "error", err)
+	}
+}
+
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,122 @@
+package backend
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Schedule restricts a range to certain days and times of day. Empty
+// fields do not restrict: a schedule with only Days applies all day on
+// those days, and one with only From and To applies every day.
+type Schedule struct {
+	Days     []string `koanf:"days" json:"days,omitempty"`         // mon, tue, ..., or weekdays/weekends
+	From     string   `koanf:"from" json:"from,omitempty"`         // HH:MM
+	To       string   `koanf:"to" json:"to,omitempty"`             // HH:MM, may be before From to span midnight
+	Timezone string   `koanf:"timezone" json:"timezone,omitempty"` // IANA name, local time if empty
+}
+
+// Validate checks the schedule fields
+func (s *Schedule) Validate() error {
+	if _, err := s.days(); err != nil {
+		return err
+	}
+	if _, _, err := clockWindow(s.From, s.To); err != nil {
+		return err
+	}
+	if _, err := time.LoadLocation(s.Timezone); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Active reports whether the schedule applies at t
+func (s *Schedule) Active(t time.Time) (bool, error) {
+	days, err := s.days()
+	if err != nil {
+		return false, err
+	}
+	from, to, err := clockWindow(s.From, s.To)
+	if err != nil {
+		return false, err
+	}
+	location, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return false, err
+	}
+	t = t.In(location)
+
+	onDay := func(t time.Time) bool {
+		return len(days) == 0 || slices.Contains(days, t.Weekday())
+	}
+	minute := t.Hour()*60 + t.Minute()
+	switch {
+	case from == to:
+		return onDay(t), nil
+	case from < to:
+		return onDay(t) && minute >= from && minute < to, nil
+	default:
+		// The part after midnight belongs to the previous day's window
+		return (minute >= from && onDay(t)) || (minute < to && onDay(t.AddDate(0, 0, -1))), nil
+	}
+}
+
+// String describes the schedule, e.g. "weekdays 22:00-07:00 Europe/London"
+func (s *Schedule) String() string {
+	var parts []string
+	if len(s.Days) > 0 {
+		parts = append(parts, strings.Join(s.Days, ","))
+	} else {
+		parts = append(parts, "daily")
+	}
+	if s.From != "" || s.To != "" {
+		parts = append(parts, s.From+"-"+s.To)
+	}
+	if s.Timezone != "" {
+		parts = append(parts, s.Timezone)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (s *Schedule) days() ([]time.Weekday, error) {
+	var days []time.Weekday
+	for _, day := range s.Days {
+		day = strings.ToLower(day)
+		switch day {
+		case "weekdays":
+			days = append(days, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday)
+		case "weekends":
+			days = append(days, time.Saturday, time.Sunday)
+		default:
+			if len(day) < 3 {
+				return nil, fmt.Errorf("invalid day: %s", day)
+			}
+			i := slices.Index(weekdays, day[:3])
+			if i < 0 {
+				return nil, fmt.Errorf("invalid day: %s", day)
+			}
+			days = append(days, time.Weekday(i))
+		}
+	}
+	return days, nil
+}
+
+// Parse a window of HH:MM times as minutes since midnight. Both empty
+// means the whole day.
+func clockWindow(fromClock, toClock string) (int, int, error) {
+	if fromClock == "" && toClock == "" {
+		return 0, 0, nil
+	}
+	from, err := time.Parse("15:04", fromClock)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid from time: %w", err)
+	}
+	to, err := time.Parse("15:04", toClock)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid to time: %w", err)
+	}
+	return from.Hour()*60 + from.Minute(), to.Hour()*60 + to.Minute(), nil
+}
@@ -0,0 +1,35 @@
+package backend
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrMetricNotFound is returned when a metric does not exist in the store
+var ErrMetricNotFound = errors.New("metric not found")
+
+// MetricStore stores status metrics and answers queries about them
+type MetricStore interface {
+	// Publish adds or replaces a metric. Metrics which are not overrides
+	// do not replace an override.
+	Publish(ctx context.Context, metric Metric) error
+	// List returns all metrics ordered by priority, highest first
+	List(ctx context.Context) ([]Metric, error)
+	// Delete removes a metric by name. Overrides are only removed by
+	// ClearOverride.
+	Delete(ctx context.Context, name string) error
+	// ClearOverride removes an override by name
+	ClearOverride(ctx context.Context, name string) error
+	// Cleanup removes metrics whose TTL has expired and returns their
+	// names, or the names it would remove on a dry run
+	Cleanup(ctx context.Context, dryRun bool) ([]string, error)
+	// Top returns the metric with the highest priority which is not
+	// suppressed, or nil if there is none
+	Top(ctx context.Context) (*Metric, error)
+	// Suppress adds or replaces a suppression, keyed by its pattern
+	Suppress(ctx context.Context, suppression Suppression) error
+	// Suppressions returns the active suppressions ordered by pattern
+	Suppressions(ctx context.Context) ([]Suppression, error)
+	// Unsuppress removes a suppression by pattern
+	Unsuppress(ctx context.Context, pattern string) error
+}
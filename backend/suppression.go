@@ -0,0 +1,130 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"path"
+	"sort"
+	"time"
+)
+
+// ErrMetricSuppressed is returned by Publish when a snooze or an
+// acknowledgement holds the metric back
+var ErrMetricSuppressed = errors.New("metric suppressed")
+
+// ErrSuppressionNotFound is returned when removing a suppression which does
+// not exist
+var ErrSuppressionNotFound = errors.New("suppression not found")
+
+// Suppression holds back metrics whose names match Pattern until Until.
+// Acknowledgements only hold back a metric up to the priority it had when
+// it was acknowledged, and are extended while the metric keeps being
+// published, so they last until the alert resolves or gets worse.
+type Suppression struct {
+	Pattern  string    `json:"pattern"`
+	Until    time.Time `json:"until"`
+	Ack      bool      `json:"ack,omitempty"`
+	Priority int       `json:"priority,omitempty"`
+}
+
+// ValidatePattern checks that pattern is a valid glob
+func ValidatePattern(pattern string) error {
+	_, err := path.Match(pattern, "")
+	return err
+}
+
+// Matches reports whether the suppression holds back metric at now
+func (s Suppression) Matches(metric Metric, now time.Time) bool {
+	if !s.Until.After(now) {
+		return false
+	}
+	if s.Ack && metric.Priority > s.Priority {
+		return false
+	}
+	matched, _ := path.Match(s.Pattern, metric.Name)
+	return matched
+}
+
+// FindSuppression returns the first suppression which holds back metric
+func FindSuppression(suppressions []Suppression, metric Metric, now time.Time) (Suppression, bool) {
+	for _, s := range suppressions {
+		if s.Matches(metric, now) {
+			return s, true
+		}
+	}
+	return Suppression{}, false
+}
+
+// Acknowledge acknowledges every metric matching pattern at its current
+// priority and returns the acknowledgements
+func Acknowledge(ctx context.Context, store MetricStore, pattern string) ([]Suppression, error) {
+	if err := ValidatePattern(pattern); err != nil {
+		return nil, err
+	}
+	metrics, err := store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	acks := []Suppression{}
+	for _, metric := range metrics {
+		if matched, _ := path.Match(pattern, metric.Name); !matched {
+			continue
+		}
+		ack := Suppression{
+			Pattern:  metric.Name,
+			Until:    metric.TTL,
+			Ack:      true,
+			Priority: metric.Priority,
+		}
+		if err := store.Suppress(ctx, ack); err != nil {
+			return nil, err
+		}
+		acks = append(acks, ack)
+	}
+	return acks, nil
+}
+
+// Stores keep suppressions alongside metrics
+type suppressionStore interface {
+	Suppress(ctx context.Context, suppression Suppression) error
+	Suppressions(ctx context.Context) ([]Suppression, error)
+}
+
+// Return ErrMetricSuppressed if metric is held back, extending the
+// acknowledgement which matched it. Overrides are never held back.
+func checkSuppressed(ctx context.Context, store suppressionStore, metric Metric) error {
+	if metric.Override {
+		return nil
+	}
+	suppressions, err := store.Suppressions(ctx)
+	if err != nil {
+		return err
+	}
+	s, ok := FindSuppression(suppressions, metric, time.Now())
+	if !ok {
+		return nil
+	}
+	if s.Ack && metric.TTL.After(s.Until) {
+		s.Until = metric.TTL
+		if err := store.Suppress(ctx, s); err != nil {
+			return err
+		}
+	}
+	slog.Debug("Metric suppressed", "metric", metric.Name, "pattern", s.Pattern, "until", s.Until)
+	return ErrMetricSuppressed
+}
+
+// Suppressions in suppressions which are still active at now
+func activeSuppressions(suppressions []Suppression, now time.Time) []Suppression {
+	active := []Suppression{}
+	for _, s := range suppressions {
+		if s.Until.After(now) {
+			active = append(active, s)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].Pattern < active[j].Pattern
+	})
+	return active
+}
@@ -0,0 +1,47 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// WebhookSink posts each raw metric as JSON to an HTTP endpoint
+type WebhookSink struct {
+	client *resty.Client
+	url    string
+}
+
+// NewWebhookSink creates a new WebhookSink
+func NewWebhookSink(url string) *WebhookSink {
+	client := resty.New().
+		SetTimeout(10*time.Second).
+		SetHeader("Content-Type", "application/json")
+	return &WebhookSink{
+		client: client,
+		url:    url,
+	}
+}
+
+// Close releases the idle connections to the webhook
+func (s *WebhookSink) Close() error {
+	s.client.GetClient().CloseIdleConnections()
+	return nil
+}
+
+// Publish posts the metric to the webhook
+func (s *WebhookSink) Publish(ctx context.Context, metric RawMetric) error {
+	resp, err := s.client.R().
+		SetContext(ctx).
+		SetBody(metric).
+		Post(s.url)
+	if err != nil {
+		return err
+	}
+	if resp.IsError() {
+		return fmt.Errorf("error: %s %s", resp.Status(), string(resp.Body()))
+	}
+	return nil
+}
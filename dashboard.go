@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"golang.org/x/term"
+
+	"github.com/venkytv/homemon/backend"
+	"github.com/venkytv/homemon/netatmo"
+)
+
+// Number of readings kept for each quantity, 12 hours at the default poll
+// interval
+const historyLength = 240
+
+// Number of readings shown in the sparklines
+const sparklineLength = 12
+
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// Marker of the selected metric
+const markSelected = ">"
+
+// A reading at a point in time
+type point struct {
+	Time  time.Time `json:"t"`
+	Value float64   `json:"v"`
+}
+
+// Readings of one quantity in one room, oldest first
+type series struct {
+	points []point
+}
+
+func (s *series) add(value float64, at time.Time) {
+	s.points = append(s.points, point{Time: at, Value: value})
+	if len(s.points) > historyLength {
+		s.points = s.points[len(s.points)-historyLength:]
+	}
+}
+
+func (s *series) latest() float64 {
+	return s.points[len(s.points)-1].Value
+}
+
+// Sparkline of the latest readings scaled between their minimum and maximum
+func (s *series) sparkline() string {
+	points := s.points[max(0, len(s.points)-sparklineLength):]
+	low, high := points[0].Value, points[0].Value
+	for _, p := range points {
+		low = min(low, p.Value)
+		high = max(high, p.Value)
+	}
+	var b strings.Builder
+	for _, p := range points {
+		i := 0
+		if high > low {
+			i = int((p.Value - low) / (high - low) * float64(len(sparkBlocks)-1))
+		}
+		b.WriteRune(sparkBlocks[i])
+	}
+	return b.String()
+}
+
+// State of the dashboard. Raw readings arrive from NATS while the metrics
+// are refreshed from the store.
+type dashboard struct {
+	config     *backend.Config
+	store      backend.MetricStore
+	rooms      []string
+	quantities []netatmo.Quantity
+	snoozeFor  time.Duration
+	opts       listOptions
+	live       bool          // Subscribed to raw metrics
+	updated    chan struct{} // Signalled after each raw reading
+
+	mu           sync.Mutex
+	readings     map[string]map[string]*series // By room and then quantity
+	metrics      []backend.Metric
+	suppressions []backend.Suppression
+	selected     string // Name of the selected metric
+	confirm      bool   // Waiting to confirm deleting the selected metric
+	status       string
+}
+
+func newDashboard(config *backend.Config, rooms []string, snoozeFor time.Duration, opts listOptions) *dashboard {
+	d := &dashboard{
+		config:     config,
+		store:      config.Store,
+		rooms:      rooms,
+		quantities: netatmo.MeasuredQuantities(),
+		snoozeFor:  snoozeFor,
+		opts:       opts,
+		readings:   make(map[string]map[string]*series),
+		updated:    make(chan struct{}, 1),
+	}
+	for _, room := range rooms {
+		d.readings[room] = make(map[string]*series)
+	}
+	return d
+}
+
+// Subscribe to the raw metrics of each quantity published under prefix
+func (d *dashboard) subscribe(nc *nats.Conn, prefix string) error {
+	if len(prefix) > 0 {
+		prefix += "."
+	}
+	for _, q := range d.quantities {
+		_, err := nc.Subscribe(prefix+q.RawName, func(msg *nats.Msg) {
+			var raw backend.RawMetric
+			if err := json.Unmarshal(msg.Data, &raw); err != nil {
+				return
+			}
+			if d.observe(raw, time.Now()) {
+				select {
+				case d.updated <- struct{}{}:
+				default:
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	d.live = true
+	return nil
+}
+
+// Record a raw reading, reporting whether it belongs on the dashboard
+func (d *dashboard) observe(raw backend.RawMetric, at time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	room, ok := d.readings[raw.Location]
+	if !ok {
+		return false
+	}
+	for _, q := range d.quantities {
+		if q.RawName != raw.Name {
+			continue
+		}
+		if room[q.Key] == nil {
+			room[q.Key] = &series{}
+		}
+		room[q.Key].add(raw.Value, at)
+		return true
+	}
+	return false
+}
+
+// Fetch the metrics and suppressions from the store
+func (d *dashboard) refresh(ctx context.Context) {
+	metrics, err := d.store.List(ctx)
+	if err != nil {
+		d.setStatus("Error listing metrics: " + err.Error())
+		return
+	}
+	suppressions, err := d.store.Suppressions(ctx)
+	if err != nil {
+		d.setStatus("Error listing suppressions: " + err.Error())
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.metrics = metrics
+	d.suppressions = suppressions
+}
+
+func (d *dashboard) setStatus(status string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.status = status
+}
+
+// Metrics sorted as in the list, keeping the selection on a metric which
+// is still there. Must be called with mu held.
+func (d *dashboard) views(now time.Time) []metricView {
+	views := make([]metricView, 0, len(d.metrics))
+	for _, metric := range d.metrics {
+		views = append(views, newMetricView(metric, d.suppressions, now))
+	}
+	sortViews(views, d.opts.sortBy, d.opts.reverse)
+	found := false
+	for _, view := range views {
+		found = found || view.Name == d.selected
+	}
+	if !found {
+		d.selected = ""
+		d.confirm = false
+		if len(views) > 0 {
+			d.selected = views[0].Name
+		}
+	}
+	return views
+}
+
+// Move the selection by delta metrics
+func (d *dashboard) move(delta int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	views := d.views(time.Now())
+	for i, view := range views {
+		if view.Name == d.selected {
+			i = max(0, min(len(views)-1, i+delta))
+			d.selected = views[i].Name
+			break
+		}
+	}
+	d.confirm = false
+}
+
+// Act on a key press, reporting whether to quit
+func (d *dashboard) handleKey(ctx context.Context, key string) bool {
+	d.mu.Lock()
+	name, confirm := d.selected, d.confirm
+	d.confirm = false
+	d.mu.Unlock()
+
+	if confirm {
+		if key == "y" {
+			d.deleteMetric(ctx, name)
+		} else {
+			d.setStatus("Not deleted")
+		}
+		return false
+	}
+
+	switch key {
+	case "q", "\x03":
+		return true
+	case "j", "\x1b[B":
+		d.move(1)
+	case "k", "\x1b[A":
+		d.move(-1)
+	case "r":
+		d.refresh(ctx)
+	case "s", "a", "u", "d":
+		if name == "" {
+			d.setStatus("No metric selected")
+			return false
+		}
+		switch key {
+		case "s":
+			d.snooze(ctx, name)
+		case "a":
+			d.acknowledge(ctx, name)
+		case "u":
+			d.unsnooze(ctx, name)
+		case "d":
+			d.mu.Lock()
+			d.confirm = true
+			d.status = fmt.Sprintf("Delete %s? (y/n)", name)
+			d.mu.Unlock()
+			return false
+		}
+		d.refresh(ctx)
+	}
+	return false
+}
+
+func (d *dashboard) snooze(ctx context.Context, name string) {
+	snooze := backend.Suppression{Pattern: name, Until: time.Now().Add(d.snoozeFor)}
+	if err := d.store.Suppress(ctx, snooze); err != nil {
+		d.setStatus("Error snoozing " + name + ": " + err.Error())
+		return
+	}
+	d.setStatus(fmt.Sprintf("Snoozed %s until %s", name, snooze.Until.Format(time.TimeOnly)))
+}
+
+func (d *dashboard) acknowledge(ctx context.Context, name string) {
+	acks, err := backend.Acknowledge(ctx, d.store, name)
+	if err != nil {
+		d.setStatus("Error acknowledging " + name + ": " + err.Error())
+		return
+	}
+	if len(acks) == 0 {
+		d.setStatus(name + " no longer exists")
+		return
+	}
+	d.setStatus(fmt.Sprintf("Acknowledged %s at priority %d", name, acks[0].Priority))
+}
+
+func (d *dashboard) unsnooze(ctx context.Context, name string) {
+	err := d.store.Unsuppress(ctx, name)
+	if errors.Is(err, backend.ErrSuppressionNotFound) {
+		d.setStatus(name + " is not snoozed or acknowledged")
+		return
+	}
+	if err != nil {
+		d.setStatus("Error unsnoozing " + name + ": " + err.Error())
+		return
+	}
+	d.setStatus("Unsnoozed " + name)
+}
+
+func (d *dashboard) deleteMetric(ctx context.Context, name string) {
+	err := d.config.DeleteMetric(ctx, name)
+	if errors.Is(err, backend.ErrMetricOverridden) {
+		d.setStatus(name + " is an override, clear it with metrics override clear")
+		return
+	}
+	if err != nil && !errors.Is(err, backend.ErrMetricNotFound) {
+		d.setStatus("Error deleting " + name + ": " + err.Error())
+		return
+	}
+	d.setStatus("Deleted " + name)
+	d.refresh(ctx)
+}
+
+// Render the rooms, the metrics and the key bindings at now
+func (d *dashboard) render(w io.Writer, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	source := "live readings from NATS"
+	if !d.live {
+		source = "readings from metric values, NATS not connected"
+	}
+	fmt.Fprintf(w, "homemon dashboard  %s  (%s)\n\n", now.Format(time.DateTime), source)
+
+	views := d.views(now)
+	byName := make(map[string]metricView)
+	for _, view := range views {
+		byName[view.Name] = view
+	}
+
+	header := []cell{{text: "ROOM"}}
+	for _, q := range d.quantities {
+		header = append(header, cell{text: strings.ToUpper(q.Label)})
+	}
+	rows := [][]cell{header}
+	for _, room := range d.rooms {
+		row := []cell{{text: room}}
+		for _, q := range d.quantities {
+			row = append(row, d.readingCell(room, q, byName))
+		}
+		rows = append(rows, row)
+	}
+	writeCells(w, rows)
+	fmt.Fprintln(w)
+
+	if len(views) == 0 {
+		fmt.Fprintln(w, "No metrics")
+	} else {
+		marks := map[string]string{d.selected: markSelected}
+		writeTable(w, views, d.opts, marks)
+	}
+	writeSuppressions(w, d.suppressions, now)
+
+	fmt.Fprintf(w, "\n%s\n", d.status)
+	fmt.Fprintf(w, "j/k select  s snooze %s  a ack  u unsnooze  d delete  r refresh  q quit\n", d.snoozeFor)
+}
+
+// Latest reading of a quantity in a room with its sparkline and the colour
+// of its metric. Without a live reading, the value of the metric is shown.
+// Must be called with mu held.
+func (d *dashboard) readingCell(room string, q netatmo.Quantity, metrics map[string]metricView) cell {
+	c := cell{text: "-"}
+	metric, hasMetric := metrics[netatmo.MetricName(q.Key, room)]
+	if s := d.readings[room][q.Key]; s != nil {
+		c.text = formatReading(s.latest(), q.Unit) + " " + s.sparkline()
+	} else if hasMetric && metric.Value != nil {
+		c.text = formatReading(*metric.Value, q.Unit)
+	}
+	if d.opts.swatches {
+		c.swatch = strings.Repeat(" ", swatchWidth)
+		if hasMetric {
+			c.swatch = swatch(metric.Colour)
+		}
+	} else if hasMetric {
+		c.text += " " + metric.Colour
+	}
+	return c
+}
+
+func formatReading(value float64, unit string) string {
+	return strconv.FormatFloat(value, 'g', 6, 64) + " " + unit
+}
+
+// Run the dashboard on the terminal until the user quits or ctx is done.
+// The metrics are refreshed every interval.
+func runDashboard(ctx context.Context, d *dashboard, interval time.Duration) error {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return fmt.Errorf("the dashboard needs a terminal")
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+
+	// Use the alternate screen and hide the cursor while running
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	keys := make(chan string)
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			if bytes.HasPrefix(buf[:n], []byte("\x1b[")) {
+				keys <- string(buf[:min(n, 3)])
+				continue
+			}
+			for _, b := range buf[:n] {
+				keys <- string(b)
+			}
+		}
+	}()
+
+	draw := func() {
+		var buf bytes.Buffer
+		buf.WriteString("\x1b[H\x1b[2J")
+		d.render(&buf, time.Now())
+		// The terminal does not translate newlines in raw mode
+		os.Stdout.Write(bytes.ReplaceAll(buf.Bytes(), []byte("\n"), []byte("\r\n")))
+	}
+	d.refresh(ctx)
+	draw()
+
+	refreshTicker := time.NewTicker(interval)
+	defer refreshTicker.Stop()
+	drawTicker := time.NewTicker(time.Second)
+	defer drawTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case key, ok := <-keys:
+			if !ok || d.handleKey(ctx, key) {
+				return nil
+			}
+		case <-d.updated:
+		case <-refreshTicker.C:
+			d.refresh(ctx)
+		case <-drawTicker.C:
+		}
+		draw()
+	}
+}
@@ -2,13 +2,22 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/go-resty/resty/v2"
+	"github.com/nats-io/nats.go"
 	"github.com/redis/go-redis/v9"
 	"github.com/urfave/cli/v2"
 
@@ -21,12 +30,27 @@ const (
 )
 
 type GlobalFlags struct {
-	configDir    string
-	redisAddress string
-	redisPrefix  string
-	natsAddress  string
-	natsPrefix   string
-	debug        bool
+	configDir     string
+	redisAddress  string
+	redisMaster   string
+	redisPrefix   string
+	store         string
+	storePath     string
+	natsAddress   string
+	natsPrefix    string
+	natsBucket    string
+	mqtt          backend.MQTTOptions
+	mqttQoS       int
+	influx        backend.InfluxOptions
+	rawWebhooks   cli.StringSlice
+	ndjson        string
+	ndjsonSize    int64
+	ndjsonAge     time.Duration
+	ndjsonGzip    bool
+	rawSinkBuffer int
+	haDiscovery   bool
+	haPrefix      string
+	debug         bool
 }
 
 func main() {
@@ -53,19 +77,38 @@ func main() {
 			},
 			&cli.StringFlag{
 				Name:        "redis-address",
-				Usage:       "Redis address",
+				Usage:       "Redis address (comma-separated for cluster or sentinel addresses)",
 				Value:       "localhost:6379",
 				Destination: &input.redisAddress,
 			},
+			&cli.StringFlag{
+				Name:        "redis-master-name",
+				Usage:       "Redis sentinel master name (enables failover client)",
+				Value:       "",
+				Destination: &input.redisMaster,
+			},
 			&cli.StringFlag{
 				Name:        "redis-prefix",
 				Usage:       "Prefix for redis keys",
 				Value:       "",
 				Destination: &input.redisPrefix,
 			},
+			&cli.StringFlag{
+				Name:        "store",
+				Usage:       "Metric store backend (redis, memory, file, nats)",
+				Value:       "redis",
+				Destination: &input.store,
+			},
+			&cli.StringFlag{
+				Name:        "store-path",
+				Usage:       "Database file for the file store (default: metrics.db in the config directory)",
+				Value:       "",
+				TakesFile:   true,
+				Destination: &input.storePath,
+			},
 			&cli.StringFlag{
 				Name:        "nats-address",
-				Usage:       "NATS address",
+				Usage:       "NATS address (NATS is disabled if empty)",
 				Value:       "localhost:4222",
 				Destination: &input.natsAddress,
 			},
@@ -75,6 +118,152 @@ func main() {
 				Value:       "",
 				Destination: &input.natsPrefix,
 			},
+			&cli.StringFlag{
+				Name:        "nats-bucket",
+				Usage:       "NATS KV bucket for the nats store",
+				Value:       Prefix,
+				Destination: &input.natsBucket,
+			},
+			&cli.StringFlag{
+				Name:        "mqtt-broker",
+				Usage:       "MQTT broker URL, e.g. tcp://localhost:1883 (MQTT is disabled if empty)",
+				Value:       "",
+				Destination: &input.mqtt.BrokerURL,
+			},
+			&cli.StringFlag{
+				Name:        "mqtt-client-id",
+				Usage:       "MQTT client ID",
+				Value:       Prefix,
+				Destination: &input.mqtt.ClientID,
+			},
+			&cli.StringFlag{
+				Name:        "mqtt-username",
+				Usage:       "MQTT username",
+				Value:       "",
+				Destination: &input.mqtt.Username,
+			},
+			&cli.StringFlag{
+				Name:        "mqtt-password",
+				Usage:       "MQTT password",
+				Value:       "",
+				EnvVars:     []string{"MQTT_PASSWORD"},
+				Destination: &input.mqtt.Password,
+			},
+			&cli.IntFlag{
+				Name:        "mqtt-qos",
+				Usage:       "MQTT QoS level (0, 1 or 2)",
+				Value:       0,
+				Destination: &input.mqttQoS,
+			},
+			&cli.BoolFlag{
+				Name:        "mqtt-retain",
+				Usage:       "Set the retain flag on published MQTT messages",
+				Value:       false,
+				Destination: &input.mqtt.Retain,
+			},
+			&cli.StringFlag{
+				Name:        "mqtt-topic",
+				Usage:       "Topic template for raw metrics",
+				Value:       backend.DefaultMQTTRawTopic,
+				Destination: &input.mqtt.RawTopic,
+			},
+			&cli.StringFlag{
+				Name:        "mqtt-status-topic",
+				Usage:       "Topic template for status metrics",
+				Value:       backend.DefaultMQTTStatusTopic,
+				Destination: &input.mqtt.StatusTopic,
+			},
+			&cli.StringSliceFlag{
+				Name:        "raw-webhook",
+				Usage:       "URL to POST raw metrics to as JSON (can be repeated)",
+				Destination: &input.rawWebhooks,
+			},
+			&cli.StringFlag{
+				Name:        "ndjson",
+				Usage:       "Write raw and status metrics as NDJSON to this file (\"-\" for stdout)",
+				Value:       "",
+				TakesFile:   true,
+				Destination: &input.ndjson,
+			},
+			&cli.Int64Flag{
+				Name:        "ndjson-max-size",
+				Usage:       "Rotate the NDJSON file once it exceeds this many megabytes (0 to disable)",
+				Value:       100,
+				Destination: &input.ndjsonSize,
+			},
+			&cli.DurationFlag{
+				Name:        "ndjson-max-age",
+				Usage:       "Rotate the NDJSON file once it is older than this (0 to disable)",
+				Value:       24 * time.Hour,
+				Destination: &input.ndjsonAge,
+			},
+			&cli.BoolFlag{
+				Name:        "ndjson-compress",
+				Usage:       "Gzip rotated NDJSON files",
+				Value:       true,
+				Destination: &input.ndjsonGzip,
+			},
+			&cli.IntFlag{
+				Name:        "raw-sink-buffer",
+				Usage:       "Number of raw metrics buffered per sink before dropping",
+				Value:       100,
+				Destination: &input.rawSinkBuffer,
+			},
+			&cli.BoolFlag{
+				Name:        "ha-discovery",
+				Usage:       "Publish Home Assistant MQTT discovery payloads",
+				Value:       false,
+				Destination: &input.haDiscovery,
+			},
+			&cli.StringFlag{
+				Name:        "ha-discovery-prefix",
+				Usage:       "Home Assistant MQTT discovery prefix",
+				Value:       "homeassistant",
+				Destination: &input.haPrefix,
+			},
+			&cli.StringFlag{
+				Name:        "influx-url",
+				Usage:       "InfluxDB URL for raw metrics: http(s)://host:8086 or udp://host:8089 (disabled if empty)",
+				Value:       "",
+				Destination: &input.influx.URL,
+			},
+			&cli.StringFlag{
+				Name:        "influx-org",
+				Usage:       "InfluxDB organisation",
+				Value:       "",
+				Destination: &input.influx.Org,
+			},
+			&cli.StringFlag{
+				Name:        "influx-bucket",
+				Usage:       "InfluxDB bucket",
+				Value:       Prefix,
+				Destination: &input.influx.Bucket,
+			},
+			&cli.StringFlag{
+				Name:        "influx-token",
+				Usage:       "InfluxDB API token",
+				Value:       "",
+				EnvVars:     []string{"INFLUX_TOKEN"},
+				Destination: &input.influx.Token,
+			},
+			&cli.DurationFlag{
+				Name:        "influx-flush-interval",
+				Usage:       "Interval between writes to InfluxDB",
+				Value:       10 * time.Second,
+				Destination: &input.influx.FlushInterval,
+			},
+			&cli.IntFlag{
+				Name:        "influx-batch-size",
+				Usage:       "Number of pending lines which triggers an early write to InfluxDB",
+				Value:       500,
+				Destination: &input.influx.BatchSize,
+			},
+			&cli.IntFlag{
+				Name:        "influx-max-retries",
+				Usage:       "Attempts per write to InfluxDB before holding lines for the next flush",
+				Value:       3,
+				Destination: &input.influx.MaxRetries,
+			},
 			&cli.BoolFlag{
 				Name:        "debug",
 				Usage:       "Enable debug mode",
@@ -90,12 +279,84 @@ func main() {
 					{
 						Name:  "record-metrics",
 						Usage: "Start metrics recording service",
+						Flags: []cli.Flag{
+							&cli.DurationFlag{
+								Name:  "poll-interval",
+								Usage: "Time between polls of each room, overriding polling.interval in the config",
+								Value: netatmo.DefaultPollInterval,
+							},
+							&cli.DurationFlag{
+								Name:  "ttl",
+								Usage: "Time to live of the metrics, overriding polling.ttl in the config",
+								Value: netatmo.DefaultMetricTTL,
+							},
+							&cli.DurationFlag{
+								Name:  "cleanup-interval",
+								Usage: "Time between cleanups of expired metrics, overriding polling.cleanup-interval in the config",
+								Value: netatmo.DefaultCleanupInterval,
+							},
+							&cli.IntFlag{
+								Name:  "workers",
+								Usage: "Number of devices polled at once, overriding polling.workers in the config",
+								Value: netatmo.DefaultWorkers,
+							},
+							&cli.DurationFlag{
+								Name:  "request-timeout",
+								Usage: "Timeout of each Netatmo API request, overriding polling.request-timeout in the config",
+								Value: netatmo.DefaultRequestTimeout,
+							},
+							&cli.IntFlag{
+								Name:  "rate-limit",
+								Usage: "Netatmo API requests allowed every rate period, overriding polling.rate-limit in the config",
+								Value: netatmo.DefaultRateLimit,
+							},
+							&cli.DurationFlag{
+								Name:  "rate-period",
+								Usage: "Period of the rate limit, overriding polling.rate-period in the config",
+								Value: netatmo.DefaultRatePeriod,
+							},
+						},
 						Action: func(c *cli.Context) error {
 							config, err := initialize(ctx, input)
 							if err != nil {
 								log.Fatal(err)
 							}
-							netatmo.RecordMetrics(ctx, config)
+							if err := initializeRawSinks(ctx, config, input); err != nil {
+								log.Fatal(err)
+							}
+							if err := initializeNotifications(config, input); err != nil {
+								log.Fatal(err)
+							}
+							// Only flags which are set override the config
+							var polling netatmo.Polling
+							if c.IsSet("poll-interval") {
+								polling.Interval = c.Duration("poll-interval")
+							}
+							if c.IsSet("ttl") {
+								polling.TTL = c.Duration("ttl")
+							}
+							if c.IsSet("cleanup-interval") {
+								polling.CleanupInterval = c.Duration("cleanup-interval")
+							}
+							if c.IsSet("workers") {
+								polling.Workers = c.Int("workers")
+							}
+							if c.IsSet("request-timeout") {
+								polling.RequestTimeout = c.Duration("request-timeout")
+							}
+							if c.IsSet("rate-limit") {
+								polling.RateLimit = c.Int("rate-limit")
+							}
+							if c.IsSet("rate-period") {
+								polling.RatePeriod = c.Duration("rate-period")
+							}
+							// Stop polling on a signal, then deliver the raw
+							// metrics still queued
+							recordCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+							defer stop()
+							netatmo.RecordMetrics(recordCtx, config, polling)
+							slog.Info("Shutting down, flushing raw metrics")
+							config.Close()
 							return nil
 						},
 					},
@@ -133,39 +394,223 @@ func main() {
 								Usage:    "Time to live of the metric",
 								Required: true,
 							},
+							&cli.Float64Flag{
+								Name:  "value",
+								Usage: "Reading which triggered the metric",
+							},
+							&cli.StringFlag{
+								Name:  "unit",
+								Usage: "Unit of the value",
+							},
+							&cli.StringFlag{
+								Name:    "message",
+								Aliases: []string{"m"},
+								Usage:   "Human-readable description of the metric",
+							},
+							&cli.StringFlag{
+								Name:  "source",
+								Usage: "Source of the metric",
+								Value: "cli",
+							},
 						},
 						Action: func(c *cli.Context) error {
 							config, err := initialize(ctx, input)
 							if err != nil {
 								log.Fatal(err)
 							}
+							defer config.Close()
 							metric := backend.Metric{
 								Name:     c.String("name"),
 								Priority: c.Int("priority"),
 								Colour:   c.String("colour"),
 								TTL:      time.Now().Add(c.Duration("ttl")),
+								Unit:     c.String("unit"),
+								Message:  c.String("message"),
+								Source:   c.String("source"),
+							}
+							if c.IsSet("value") {
+								value := c.Float64("value")
+								metric.Value = &value
 							}
 							slog.Debug("Publishing metric", "metric", metric)
-							if err := config.Publisher.Publish(ctx, metric); err != nil {
+							if err := config.PublishMetric(ctx, metric); err != nil {
+								if errors.Is(err, backend.ErrMetricSuppressed) {
+									fmt.Printf("Metric %s is snoozed, not published\n", metric.Name)
+									return nil
+								}
+								if errors.Is(err, backend.ErrMetricOverridden) {
+									fmt.Printf("Metric %s is overridden, not published\n", metric.Name)
+									return nil
+								}
 								log.Fatal(err)
 							}
 							return nil
 						},
 					},
+					{
+						Name:  "evaluate",
+						Usage: "Publish a metric with the priority and colour of the range its value falls in, or delete it if none matches",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "name",
+								Aliases:  []string{"n"},
+								Usage:    "Name of the metric",
+								Required: true,
+							},
+							&cli.Float64Flag{
+								Name:     "value",
+								Usage:    "Reading to evaluate",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:     "ranges",
+								Usage:    "Name of the ranges under metrics in the netatmo config, e.g. temperature",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:  "room",
+								Usage: "Merge in the range overrides of this room",
+							},
+							&cli.DurationFlag{
+								Name:    "ttl",
+								Aliases: []string{"t"},
+								Usage:   "Time to live of the metric (default: the metric TTL of --room, or polling.ttl in the netatmo config)",
+							},
+							&cli.StringFlag{
+								Name:  "unit",
+								Usage: "Unit of the value",
+							},
+							&cli.StringFlag{
+								Name:    "message",
+								Aliases: []string{"m"},
+								Usage:   "Human-readable description of the metric",
+							},
+							&cli.StringFlag{
+								Name:  "source",
+								Usage: "Source of the metric",
+								Value: "cli",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							ranges, err := netatmo.LoadRanges(input.configDir, c.String("ranges"), c.String("room"))
+							if err != nil {
+								log.Fatal(err)
+							}
+							// Default to the TTL the collector would use
+							ttl := c.Duration("ttl")
+							if !c.IsSet("ttl") {
+								ttl, err = netatmo.MetricTTL(input.configDir, c.String("room"))
+								if err != nil {
+									log.Fatal(err)
+								}
+							}
+							config, err := initialize(ctx, input)
+							if err != nil {
+								log.Fatal(err)
+							}
+							defer config.Close()
+							name := c.String("name")
+							value := c.Float64("value")
+							metricRange, ok := backend.FindRange(ranges, value, time.Now())
+							if !ok {
+								err := config.DeleteMetric(ctx, name)
+								if errors.Is(err, backend.ErrMetricOverridden) {
+									fmt.Printf("No range matches %g, metric %s is overridden, not cleared\n", value, name)
+									return nil
+								}
+								if err != nil && !errors.Is(err, backend.ErrMetricNotFound) {
+									log.Fatal(err)
+								}
+								fmt.Printf("No range matches %g, metric %s cleared\n", value, name)
+								return nil
+							}
+							metric := backend.MetricGenerator(name, ttl)(metricRange.Priority, metricRange.Colour)
+							metric.Value = &value
+							metric.Unit = c.String("unit")
+							metric.Message = c.String("message")
+							metric.Source = c.String("source")
+							slog.Debug("Publishing metric", "metric", metric)
+							if err := config.PublishMetric(ctx, metric); err != nil {
+								if errors.Is(err, backend.ErrMetricSuppressed) {
+									fmt.Printf("Metric %s is snoozed, not published\n", metric.Name)
+									return nil
+								}
+								if errors.Is(err, backend.ErrMetricOverridden) {
+									fmt.Printf("Metric %s is overridden, not published\n", metric.Name)
+									return nil
+								}
+								log.Fatal(err)
+							}
+							fmt.Printf("Published %s at priority %d (%s)\n", metric.Name, metric.Priority, metric.Colour)
+							return nil
+						},
+					},
 					{
 						Name:  "list",
 						Usage: "List metrics",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:    "output",
+								Aliases: []string{"o"},
+								Usage:   "Output format: " + strings.Join(outputFormats, ", "),
+								Value:   "table",
+							},
+							&cli.StringFlag{
+								Name:  "template",
+								Usage: "Go template applied to each metric for the template output, e.g. '{{.Name}} {{.Colour}}'",
+							},
+							&cli.StringFlag{
+								Name:  "sort",
+								Usage: "Sort order: " + strings.Join(sortOrders, ", "),
+								Value: "priority",
+							},
+							&cli.BoolFlag{
+								Name:    "reverse",
+								Aliases: []string{"r"},
+								Usage:   "Reverse the sort order",
+							},
+							&cli.BoolFlag{
+								Name:    "watch",
+								Aliases: []string{"w"},
+								Usage:   "Keep refreshing the table, marking metrics which appeared (+), changed (~) or disappeared (-)",
+							},
+							&cli.DurationFlag{
+								Name:  "interval",
+								Usage: "Interval between refreshes in watch mode",
+								Value: 5 * time.Second,
+							},
+						},
 						Action: func(c *cli.Context) error {
+							opts, err := newListOptions(c)
+							if err != nil {
+								log.Fatal(err)
+							}
+							if c.Bool("watch") && opts.output != "table" {
+								log.Fatal("Watch mode only supports the table output")
+							}
+							if c.Duration("interval") <= 0 {
+								log.Fatal("Interval must be positive")
+							}
 							config, err := initialize(ctx, input)
 							if err != nil {
 								log.Fatal(err)
 							}
-							metrics, err := config.Publisher.ListMetrics(ctx, config)
+							if c.Bool("watch") {
+								watchCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+								defer stop()
+								watchMetrics(watchCtx, os.Stdout, config.Store, c.Duration("interval"), opts)
+								return nil
+							}
+							metrics, err := config.Store.List(ctx)
+							if err != nil {
+								log.Fatal(err)
+							}
+							suppressions, err := config.Store.Suppressions(ctx)
 							if err != nil {
 								log.Fatal(err)
 							}
-							for _, metric := range metrics {
-								fmt.Printf("%s: priority: %d, colour: %s, ttl: %s\n", metric.Name, metric.Priority, metric.Colour, metric.TTL)
+							if err := writeMetrics(os.Stdout, metrics, suppressions, time.Now(), opts); err != nil {
+								log.Fatal(err)
 							}
 							return nil
 						},
@@ -182,12 +627,318 @@ func main() {
 							if err != nil {
 								log.Fatal(err)
 							}
-							if err := config.Publisher.DeleteMetric(ctx, name); err != nil {
+							if err := config.DeleteMetric(ctx, name); err != nil {
+								if errors.Is(err, backend.ErrMetricNotFound) {
+									log.Fatalf("Metric %s does not exist", name)
+								}
+								if errors.Is(err, backend.ErrMetricOverridden) {
+									log.Fatalf("Metric %s is an override, clear it with metrics override clear", name)
+								}
+								log.Fatal(err)
+							}
+							return nil
+						},
+					},
+					{
+						Name:  "top",
+						Usage: "Show the metric which wins, taking overrides and snoozes into account",
+						Action: func(c *cli.Context) error {
+							config, err := initialize(ctx, input)
+							if err != nil {
+								log.Fatal(err)
+							}
+							metric, err := config.Store.Top(ctx)
+							if err != nil {
 								log.Fatal(err)
 							}
+							if metric == nil {
+								fmt.Println("No metrics")
+								return nil
+							}
+							fmt.Println(metricLine(*metric, nil, time.Now()))
 							return nil
 						},
 					},
+					{
+						Name:  "override",
+						Usage: "Override commands",
+						Subcommands: []*cli.Command{
+							{
+								Name:  "set",
+								Usage: "Set a metric which wins over all others until cleared",
+								Flags: []cli.Flag{
+									&cli.StringFlag{
+										Name:     "name",
+										Aliases:  []string{"n"},
+										Usage:    "Name of the override",
+										Required: true,
+									},
+									&cli.StringFlag{
+										Name:     "colour",
+										Aliases:  []string{"c"},
+										Usage:    "Colour of the override",
+										Required: true,
+									},
+									&cli.IntFlag{
+										Name:    "priority",
+										Aliases: []string{"p"},
+										Usage:   "Priority of the override, which decides between overrides",
+									},
+									&cli.StringSliceFlag{
+										Name:  "days",
+										Usage: "Days the override applies on (mon..sun, weekdays or weekends)",
+									},
+									&cli.StringFlag{
+										Name:  "from",
+										Usage: "Time of day the override starts applying (HH:MM)",
+									},
+									&cli.StringFlag{
+										Name:  "to",
+										Usage: "Time of day the override stops applying (HH:MM)",
+									},
+									&cli.StringFlag{
+										Name:  "timezone",
+										Usage: "Timezone of the schedule (local time if empty)",
+									},
+								},
+								Action: func(c *cli.Context) error {
+									metric := backend.Metric{
+										Name:     c.String("name"),
+										Priority: c.Int("priority"),
+										Colour:   c.String("colour"),
+										Override: true,
+									}
+									if c.IsSet("days") || c.IsSet("from") || c.IsSet("to") || c.IsSet("timezone") {
+										metric.Schedule = &backend.Schedule{
+											Days:     c.StringSlice("days"),
+											From:     c.String("from"),
+											To:       c.String("to"),
+											Timezone: c.String("timezone"),
+										}
+										if err := metric.Schedule.Validate(); err != nil {
+											log.Fatalf("Invalid schedule: %s", err)
+										}
+									}
+									config, err := initialize(ctx, input)
+									if err != nil {
+										log.Fatal(err)
+									}
+									defer config.Close()
+									slog.Debug("Setting override", "metric", metric)
+									if err := config.PublishMetric(ctx, metric); err != nil {
+										log.Fatal(err)
+									}
+									return nil
+								},
+							},
+							{
+								Name:      "clear",
+								Usage:     "Clear an override",
+								ArgsUsage: "<name>",
+								Action: func(c *cli.Context) error {
+									name := c.Args().First()
+									if name == "" {
+										log.Fatal("Name of the override is required")
+									}
+									config, err := initialize(ctx, input)
+									if err != nil {
+										log.Fatal(err)
+									}
+									if err := config.ClearOverride(ctx, name); err != nil {
+										switch {
+										case errors.Is(err, backend.ErrMetricNotFound):
+											log.Fatalf("Override %s does not exist", name)
+										case errors.Is(err, backend.ErrNotOverride):
+											log.Fatalf("Metric %s is not an override", name)
+										}
+										log.Fatal(err)
+									}
+									return nil
+								},
+							},
+						},
+					},
+					{
+						Name:      "snooze",
+						Usage:     "Hold back metrics matching a name or glob for a while",
+						ArgsUsage: "<name-or-glob>",
+						Flags: []cli.Flag{
+							&cli.DurationFlag{
+								Name:  "for",
+								Usage: "How long to snooze the metrics (required)",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							pattern := c.Args().First()
+							if pattern == "" {
+								log.Fatal("Name or glob of the metrics is required")
+							}
+							if err := setTrailingFlags(c); err != nil {
+								log.Fatal(err)
+							}
+							if c.Duration("for") <= 0 {
+								log.Fatal("Snooze duration (--for) is required")
+							}
+							if err := backend.ValidatePattern(pattern); err != nil {
+								log.Fatalf("Invalid pattern %s: %s", pattern, err)
+							}
+							config, err := initialize(ctx, input)
+							if err != nil {
+								log.Fatal(err)
+							}
+							snooze := backend.Suppression{
+								Pattern: pattern,
+								Until:   time.Now().Add(c.Duration("for")),
+							}
+							if err := config.Store.Suppress(ctx, snooze); err != nil {
+								log.Fatal(err)
+							}
+							fmt.Printf("Snoozed %s until %s\n", pattern, snooze.Until.Format(time.DateTime))
+							return nil
+						},
+					},
+					{
+						Name:      "ack",
+						Usage:     "Acknowledge metrics matching a name or glob until they resolve or get worse",
+						ArgsUsage: "<name-or-glob>",
+						Action: func(c *cli.Context) error {
+							pattern := c.Args().First()
+							if pattern == "" {
+								log.Fatal("Name or glob of the metrics is required")
+							}
+							config, err := initialize(ctx, input)
+							if err != nil {
+								log.Fatal(err)
+							}
+							acks, err := backend.Acknowledge(ctx, config.Store, pattern)
+							if err != nil {
+								log.Fatal(err)
+							}
+							if len(acks) == 0 {
+								log.Fatalf("No metrics match %s", pattern)
+							}
+							for _, ack := range acks {
+								fmt.Printf("Acknowledged %s at priority %d\n", ack.Pattern, ack.Priority)
+							}
+							return nil
+						},
+					},
+					{
+						Name:      "unsnooze",
+						Usage:     "Remove a snooze or acknowledgement",
+						ArgsUsage: "<name-or-glob>",
+						Action: func(c *cli.Context) error {
+							pattern := c.Args().First()
+							if pattern == "" {
+								log.Fatal("Name or glob of the snooze is required")
+							}
+							config, err := initialize(ctx, input)
+							if err != nil {
+								log.Fatal(err)
+							}
+							if err := config.Store.Unsuppress(ctx, pattern); err != nil {
+								if errors.Is(err, backend.ErrSuppressionNotFound) {
+									log.Fatalf("%s is not snoozed or acknowledged", pattern)
+								}
+								log.Fatal(err)
+							}
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "dashboard",
+				Usage: "Show the rooms and metrics in an interactive terminal view",
+				Flags: []cli.Flag{
+					&cli.DurationFlag{
+						Name:  "interval",
+						Usage: "Interval between refreshes of the metrics",
+						Value: 5 * time.Second,
+					},
+					&cli.DurationFlag{
+						Name:  "snooze-for",
+						Usage: "How long the snooze key snoozes the selected metric",
+						Value: time.Hour,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.Duration("interval") <= 0 {
+						log.Fatal("Interval must be positive")
+					}
+					if c.Duration("snooze-for") <= 0 {
+						log.Fatal("Snooze duration must be positive")
+					}
+					rooms, err := netatmo.Rooms(input.configDir)
+					if err != nil {
+						log.Fatal(err)
+					}
+					config, err := initialize(ctx, input)
+					if err != nil {
+						log.Fatal(err)
+					}
+					// Logs would draw over the dashboard
+					slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+					opts := listOptions{
+						output:   "table",
+						sortBy:   "priority",
+						swatches: truecolour(os.Stdout),
+						styled:   styled(os.Stdout),
+					}
+					d := newDashboard(config, rooms, c.Duration("snooze-for"), opts)
+					if config.NATSClient != nil {
+						if err := d.subscribe(config.NATSClient, input.natsPrefix); err != nil {
+							log.Fatal(err)
+						}
+					}
+					dashboardCtx, stop := signal.NotifyContext(ctx, syscall.SIGTERM)
+					defer stop()
+					if err := runDashboard(dashboardCtx, d, c.Duration("interval")); err != nil {
+						log.Fatal(err)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "web",
+				Usage: "Serve a web dashboard of the rooms and metrics",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "listen",
+						Usage: "Address to serve the dashboard on",
+						Value: ":8080",
+					},
+					&cli.DurationFlag{
+						Name:  "interval",
+						Usage: "Interval between refreshes of the metrics",
+						Value: 5 * time.Second,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.Duration("interval") <= 0 {
+						log.Fatal("Interval must be positive")
+					}
+					rooms, err := netatmo.Rooms(input.configDir)
+					if err != nil {
+						log.Fatal(err)
+					}
+					config, err := initialize(ctx, input)
+					if err != nil {
+						log.Fatal(err)
+					}
+					d := newDashboard(config, rooms, 0, listOptions{sortBy: "priority"})
+					if config.NATSClient != nil {
+						if err := d.subscribe(config.NATSClient, input.natsPrefix); err != nil {
+							log.Fatal(err)
+						}
+					}
+					webCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+					defer stop()
+					if err := serveWeb(webCtx, d, c.String("listen"), c.Duration("interval")); err != nil {
+						log.Fatal(err)
+					}
+					return nil
 				},
 			},
 			{
@@ -196,7 +947,7 @@ func main() {
 				Subcommands: []*cli.Command{
 					{
 						Name:  "metrics",
-						Usage: "Cleanup metrics in redis",
+						Usage: "Cleanup expired metrics in the store",
 						Flags: []cli.Flag{
 							&cli.BoolFlag{
 								Name:  "dry-run",
@@ -214,6 +965,30 @@ func main() {
 					},
 				},
 			},
+			{
+				Name:  "config",
+				Usage: "Config commands",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "show",
+						Usage: "Show the netatmo config",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "effective",
+								Usage: "Show the ranges which apply to each room after merging room overrides",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							out, err := netatmo.ShowConfig(input.configDir, c.Bool("effective"))
+							if err != nil {
+								log.Fatal(err)
+							}
+							fmt.Print(string(out))
+							return nil
+						},
+					},
+				},
+			},
 		},
 	}
 
@@ -222,16 +997,25 @@ func main() {
 	}
 }
 
-func initialize(_ context.Context, input GlobalFlags) (*backend.Config, error) {
+func initialize(ctx context.Context, input GlobalFlags) (*backend.Config, error) {
 	// Configure the logger
 	var programLevel = new(slog.LevelVar)
-	h := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: programLevel})
+	// Log to stderr so that stdout only carries command output, such as
+	// metrics list in a machine-readable format or the NDJSON stream
+	h := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: programLevel})
 	slog.SetDefault(slog.New(h))
 	if input.debug {
 		programLevel.Set(slog.LevelDebug)
 		slog.Debug("Debug mode enabled")
 	}
-	slog.Debug("Global flags", "flags", input)
+	loggedInput := input
+	if len(loggedInput.mqtt.Password) > 0 {
+		loggedInput.mqtt.Password = "********"
+	}
+	if len(loggedInput.influx.Token) > 0 {
+		loggedInput.influx.Token = "********"
+	}
+	slog.Debug("Global flags", "flags", loggedInput)
 
 	// Initialize the configuration directory
 	if err := os.MkdirAll(input.configDir, 0755); err != nil {
@@ -249,27 +1033,236 @@ func initialize(_ context.Context, input GlobalFlags) (*backend.Config, error) {
 	restyClient.SetTimeout(30 * time.Second)
 	config.RestyClient = restyClient
 
-	// Initialize the redis client
-	redisClient := redis.NewClient(&redis.Options{
-		Addr: input.redisAddress,
-	})
-	config.RedisClient = redisClient
+	// Initialize the NATS client
+	var natsClient *nats.Conn
+	if len(input.natsAddress) > 0 {
+		var err error
+		natsClient, err = nats.Connect(input.natsAddress)
+		if err != nil {
+			// Disable NATS if it fails to initialize
+			slog.Warn("Failed to connect to NATS", "error", err)
+			natsClient = nil
+		}
+	}
+	config.NATSClient = natsClient
 
-	// Initialize the publisher
-	prefix := Prefix
-	if len(input.redisPrefix) > 0 {
-		prefix = input.redisPrefix + ":" + prefix
+	// Initialize the metric store
+	switch input.store {
+	case "redis":
+		redisClient := redis.NewUniversalClient(&redis.UniversalOptions{
+			Addrs:      strings.Split(input.redisAddress, ","),
+			MasterName: input.redisMaster,
+		})
+		config.RedisClient = redisClient
+
+		prefix := Prefix
+		if len(input.redisPrefix) > 0 {
+			prefix = input.redisPrefix + ":" + prefix
+		}
+		config.Store = backend.NewPublisher(redisClient, prefix)
+	case "memory":
+		config.Store = backend.NewMemoryStore()
+	case "file":
+		storePath := input.storePath
+		if storePath == "" {
+			storePath = filepath.Join(input.configDir, "metrics.db")
+		}
+		config.Store = backend.NewBoltStore(storePath)
+	case "nats":
+		if natsClient == nil {
+			return nil, fmt.Errorf("NATS store requires a NATS connection")
+		}
+		kvStore, err := backend.NewKVStore(natsClient, input.natsBucket)
+		if err != nil {
+			return nil, err
+		}
+		config.Store = kvStore
+	default:
+		return nil, fmt.Errorf("unknown metric store: %s", input.store)
 	}
-	config.Publisher = backend.NewPublisher(input.redisAddress, prefix)
 
-	// Initialize the NATS client
-	natsPublisher, err := backend.NewNATSPublisher(input.natsAddress, input.natsPrefix)
-	if err != nil {
-		// Disable NATS publisher if it fails to initialize
-		slog.Warn("Failed to initialize NATS publisher", "error", err)
-		natsPublisher = nil
+	// Initialize the MQTT publisher
+	if len(input.mqtt.BrokerURL) > 0 {
+		input.mqtt.QoS = byte(input.mqttQoS)
+		mqttClient, err := backend.NewMQTTClient(ctx, input.mqtt)
+		if err != nil {
+			// Disable MQTT if it fails to connect, as for NATS
+			slog.Warn("Failed to connect to MQTT broker", "error", err)
+		} else {
+			config.MQTTPublisher, err = backend.NewMQTTPublisher(mqttClient, input.mqtt)
+			if err != nil {
+				return nil, err
+			}
+			if input.haDiscovery {
+				config.HADiscoveryPrefix = input.haPrefix
+			}
+			config.StatusSinks = append(config.StatusSinks, config.MQTTPublisher)
+		}
+	}
+
+	// Initialize the NDJSON sink
+	if len(input.ndjson) > 0 {
+		if input.ndjson == "-" {
+			config.NDJSONSink = backend.NewNDJSONSink(os.Stdout)
+		} else {
+			var err error
+			config.NDJSONSink, err = backend.NewNDJSONFileSink(input.ndjson, input.ndjsonSize*1024*1024, input.ndjsonAge, input.ndjsonGzip)
+			if err != nil {
+				return nil, err
+			}
+		}
+		config.StatusSinks = append(config.StatusSinks, config.NDJSONSink)
 	}
-	config.RawPublisher = natsPublisher
 
 	return config, nil
 }
+
+// Wrap the store to send notifications if configured. The alert state is
+// kept in memory, so only the long-running collector sends notifications.
+func initializeNotifications(config *backend.Config, input GlobalFlags) error {
+	notifyConfig, err := backend.LoadNotifyConfig(filepath.Join(input.configDir, backend.NotifyConfigFile))
+	if err != nil {
+		return err
+	}
+	if notifyConfig != nil {
+		config.Store = backend.NewNotifyingStore(config.Store, *notifyConfig)
+	}
+	return nil
+}
+
+// Attach the raw metric sinks, which only the commands publishing raw
+// metrics need. They run until the config is closed, so ctx should outlive
+// any shutdown signal for queued metrics to be delivered.
+func initializeRawSinks(ctx context.Context, config *backend.Config, input GlobalFlags) error {
+	config.RawSinks = backend.NewRawMux(ctx, input.rawSinkBuffer)
+	if config.NATSClient != nil {
+		config.RawSinks.Add("nats", backend.NewNATSPublisher(config.NATSClient, input.natsPrefix))
+	}
+	if config.MQTTPublisher != nil {
+		config.RawSinks.Add("mqtt", config.MQTTPublisher)
+	}
+
+	// Initialize the InfluxDB publisher
+	if len(input.influx.URL) > 0 {
+		influxPublisher, err := backend.NewInfluxPublisher(ctx, input.influx)
+		if err != nil {
+			return err
+		}
+		config.RawSinks.Add("influx", influxPublisher)
+	}
+
+	for _, url := range input.rawWebhooks.Value() {
+		config.RawSinks.Add("webhook "+url, backend.NewWebhookSink(url))
+	}
+
+	if config.NDJSONSink != nil {
+		config.RawSinks.Add("ndjson", config.NDJSONSink)
+	}
+	return nil
+}
+
+// Read the options of metrics list from its flags
+func newListOptions(c *cli.Context) (listOptions, error) {
+	opts := listOptions{
+		output:   c.String("output"),
+		sortBy:   c.String("sort"),
+		reverse:  c.Bool("reverse"),
+		swatches: truecolour(os.Stdout),
+		styled:   styled(os.Stdout),
+	}
+	if c.IsSet("template") && !c.IsSet("output") {
+		opts.output = "template"
+	}
+	if !slices.Contains(outputFormats, opts.output) {
+		return opts, fmt.Errorf("unknown output format: %s", opts.output)
+	}
+	if !slices.Contains(sortOrders, opts.sortBy) {
+		return opts, fmt.Errorf("unknown sort order: %s", opts.sortBy)
+	}
+	if opts.output == "template" {
+		if !c.IsSet("template") {
+			return opts, fmt.Errorf("--template is required for the template output")
+		}
+		tmpl, err := template.New("metric").Parse(c.String("template"))
+		if err != nil {
+			return opts, err
+		}
+		opts.template = tmpl
+	}
+	return opts, nil
+}
+
+// urfave/cli stops parsing flags at the first argument, so pick up flags
+// given after it, as in "metrics snooze co2:* --for 30m"
+func setTrailingFlags(c *cli.Context) error {
+	args := c.Args().Tail()
+	for i := 0; i < len(args); i++ {
+		flag := args[i]
+		if !strings.HasPrefix(flag, "-") {
+			return fmt.Errorf("unexpected argument: %s", flag)
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(flag, "-"), "=")
+		if !hasValue {
+			if i+1 == len(args) {
+				return fmt.Errorf("flag needs an argument: %s", flag)
+			}
+			i++
+			value = args[i]
+		}
+		if err := c.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value %q for flag %s: %w", value, flag, err)
+		}
+	}
+	return nil
+}
+
+// Describe a metric for the metrics commands
+func metricLine(metric backend.Metric, suppressions []backend.Suppression, now time.Time) string {
+	if metric.Override {
+		state := "active"
+		if !metric.OverrideActive(now) {
+			state = "inactive"
+		}
+		line := fmt.Sprintf("%s: override (%s), priority: %d, colour: %s", metric.Name, state, metric.Priority, metric.Colour)
+		if metric.Schedule != nil {
+			line += ", schedule: " + metric.Schedule.String()
+		}
+		return line + metadataLine(metric)
+	}
+	line := fmt.Sprintf("%s: priority: %d, colour: %s, ttl: %s", metric.Name, metric.Priority, metric.Colour, metric.TTL)
+	if s, ok := backend.FindSuppression(suppressions, metric, now); ok {
+		line += ", " + suppressionState(s, now)
+	}
+	return line + metadataLine(metric)
+}
+
+// Describe the metadata of a metric, which metrics published by older
+// versions do not have
+func metadataLine(metric backend.Metric) string {
+	var line string
+	if metric.Value != nil {
+		line += fmt.Sprintf(", value: %g", *metric.Value)
+		if metric.Unit != "" {
+			line += " " + metric.Unit
+		}
+	}
+	if metric.Message != "" {
+		line += fmt.Sprintf(", message: %q", metric.Message)
+	}
+	if metric.Source != "" {
+		line += ", source: " + metric.Source
+	}
+	if !metric.UpdatedAt.IsZero() {
+		line += ", updated: " + metric.UpdatedAt.Format(time.DateTime)
+	}
+	return line
+}
+
+// Describe a suppression and the time it has left
+func suppressionState(s backend.Suppression, now time.Time) string {
+	left := s.Until.Sub(now).Round(time.Second)
+	if s.Ack {
+		return fmt.Sprintf("acknowledged at priority %d, %s left", s.Priority, left)
+	}
+	return fmt.Sprintf("snoozed, %s left", left)
+}
@@ -0,0 +1,117 @@
+package netatmo
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/knadh/koanf/parsers/yaml"
+	"github.com/knadh/koanf/providers/file"
+	"github.com/knadh/koanf/v2"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// Load the netatmo config file from the config directory
+func loadConfig(configDir string) (*koanf.Koanf, error) {
+	configFile := path.Join(configDir, NetatmoConfigFile)
+	k := koanf.New(".")
+	if err := k.Load(file.Provider(configFile), yaml.Parser()); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Rooms returns the rooms configured in mac-ids, sorted by name
+func Rooms(configDir string) ([]string, error) {
+	k, err := loadConfig(configDir)
+	if err != nil {
+		return nil, fmt.Errorf("error loading config file: %w", err)
+	}
+	rooms := roomNames(k.StringMap("mac-ids"))
+	if len(rooms) == 0 {
+		return nil, fmt.Errorf("no rooms in mac-ids")
+	}
+	sort.Strings(rooms)
+	return rooms, nil
+}
+
+// Effective ranges of a quantity in a room, as shown by ShowConfig
+type effectiveRanges struct {
+	Merge  string           `yaml:"merge"`
+	Ranges []effectiveRange `yaml:"ranges"`
+}
+
+type effectiveRange struct {
+	From     float64            `yaml:"from"`
+	To       float64            `yaml:"to"`
+	Priority int                `yaml:"priority"`
+	Colour   string             `yaml:"colour"`
+	Schedule *effectiveSchedule `yaml:"schedule,omitempty"`
+	Source   string             `yaml:"source"`
+}
+
+type effectiveSchedule struct {
+	Days     []string `yaml:"days,omitempty,flow"`
+	From     string   `yaml:"from"`
+	To       string   `yaml:"to"`
+	Timezone string   `yaml:"timezone,omitempty"`
+}
+
+// ShowConfig renders the netatmo config as YAML. With effective set, it
+// renders the ranges which apply to each room after merging the room
+// overrides with the global ranges, along with the merge strategy used and
+// where each range came from.
+func ShowConfig(configDir string, effective bool) ([]byte, error) {
+	k, err := loadConfig(configDir)
+	if err != nil {
+		return nil, fmt.Errorf("error loading config file: %w", err)
+	}
+	if !effective {
+		return k.Marshal(yaml.Parser())
+	}
+
+	ranges, err := loadRanges(k, roomNames(k.MustStringMap("mac-ids")))
+	if err != nil {
+		return nil, fmt.Errorf("error loading metric ranges: %w", err)
+	}
+
+	rooms := make(map[string]map[string]map[string]effectiveRanges)
+	for room, roomQuantities := range ranges {
+		metrics := make(map[string]effectiveRanges)
+		for q, merged := range roomQuantities {
+			if len(merged.Ranges) == 0 {
+				continue
+			}
+			out := effectiveRanges{Merge: merged.Merge}
+			for i, metricRange := range merged.Ranges {
+				entry := effectiveRange{
+					From:     metricRange.From,
+					To:       metricRange.To,
+					Priority: metricRange.Priority,
+					Colour:   metricRange.Colour,
+					Source:   merged.Sources[i],
+				}
+				if s := metricRange.Schedule; s != nil {
+					entry.Schedule = &effectiveSchedule{
+						Days:     s.Days,
+						From:     s.From,
+						To:       s.To,
+						Timezone: s.Timezone,
+					}
+				}
+				out.Ranges = append(out.Ranges, entry)
+			}
+			metrics[q] = out
+		}
+		rooms[room] = map[string]map[string]effectiveRanges{"metrics": metrics}
+	}
+
+	var buf bytes.Buffer
+	enc := yamlv3.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(map[string]interface{}{"rooms": rooms}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,93 @@
+package netatmo
+
+import (
+	"math"
+	"time"
+
+	"github.com/venkytv/homemon/rules"
+)
+
+const (
+	// Rates of change are computed over this span
+	rateSpan = time.Hour
+	// Minimum history needed before a rate is reported
+	minRateSpan = 10 * time.Minute
+)
+
+// Quantities whose hourly rate of change is derived, keyed by the derived
+// quantity
+var rateQuantities = map[string]string{
+	"temperature-rate": "temperature",
+	"humidity-rate":    "humidity",
+	"co2-rate":         "co2",
+}
+
+// Computes derived quantities from the Home Coach readings
+type deriver struct {
+	history *rules.Window
+}
+
+func newDeriver() *deriver {
+	return &deriver{
+		history: rules.NewWindow(rateSpan),
+	}
+}
+
+// Add derived quantities to the readings of a room. Rates are omitted until
+// enough history has been collected.
+func (d *deriver) derive(room string, now time.Time, readings map[string]float64) {
+	temperature := readings["temperature"]
+	humidity := readings["humidity"]
+
+	if humidity > 0 {
+		readings["dewpoint"] = dewPoint(temperature, humidity)
+		readings["absolute-humidity"] = absoluteHumidity(temperature, humidity)
+	}
+	readings["heat-index"] = heatIndex(temperature, humidity)
+
+	for rateKey, key := range rateQuantities {
+		d.history.Add(room, key, now, readings[key])
+		samples := d.history.Since(room, key, now.Add(-rateSpan), now)
+		if len(samples) < 2 {
+			continue
+		}
+		first, last := samples[0], samples[len(samples)-1]
+		elapsed := last.Time.Sub(first.Time)
+		if elapsed < minRateSpan {
+			continue
+		}
+		readings[rateKey] = (last.Value - first.Value) / elapsed.Hours()
+	}
+}
+
+// Dew point in °C using the Magnus formula
+func dewPoint(temperature, humidity float64) float64 {
+	const a, b = 17.62, 243.12
+	gamma := math.Log(humidity/100) + a*temperature/(b+temperature)
+	return b * gamma / (a - gamma)
+}
+
+// Absolute humidity in g/m³
+func absoluteHumidity(temperature, humidity float64) float64 {
+	saturation := 6.112 * math.Exp(17.67*temperature/(temperature+243.5))
+	return saturation * humidity * 2.1674 / (273.15 + temperature)
+}
+
+// Heat index in °C using the NWS Rothfusz regression
+// (https://www.wpc.ncep.noaa.gov/html/heatindex_equation.shtml)
+func heatIndex(temperature, humidity float64) float64 {
+	t := temperature*9/5 + 32
+	hi := 0.5 * (t + 61 + (t-68)*1.2 + humidity*0.094)
+	if (hi+t)/2 >= 80 {
+		hi = -42.379 + 2.04901523*t + 10.14333127*humidity -
+			0.22475541*t*humidity - 0.00683783*t*t -
+			0.05481717*humidity*humidity + 0.00122874*t*t*humidity +
+			0.00085282*t*humidity*humidity - 0.00000199*t*t*humidity*humidity
+		if humidity < 13 && t >= 80 && t <= 112 {
+			hi -= (13 - humidity) / 4 * math.Sqrt((17-math.Abs(t-95))/17)
+		} else if humidity > 85 && t >= 80 && t <= 87 {
+			hi += (humidity - 85) / 10 * (87 - t) / 5
+		}
+	}
+	return (hi - 32) * 5 / 9
+}
@@ -0,0 +1,76 @@
+package netatmo
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"golang.org/x/time/rate"
+
+	"github.com/venkytv/homemon/backend"
+)
+
+// Readings of the Home Coach in a room, or the error fetching them
+type roomFetch struct {
+	room     string
+	readings map[string]float64
+	err      error
+}
+
+// Fetch the readings of the given rooms with up to the configured number of
+// workers, sending each room's result as soon as it arrives. The channel is
+// closed once every room has been fetched.
+func fetchRooms(ctx context.Context, config *backend.Config, schedule *pollSchedule, accessToken string, macIdMap map[string]string, rooms []string) <-chan roomFetch {
+	jobs := make(chan string)
+	results := make(chan roomFetch)
+
+	var wg sync.WaitGroup
+	for i := 0; i < min(schedule.workers, len(rooms)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for room := range jobs {
+				readings, err := fetchReadings(ctx, config, schedule.limiter, accessToken, macIdMap[room])
+				results <- roomFetch{room: room, readings: readings, err: err}
+			}
+		}()
+	}
+	go func() {
+		for _, room := range rooms {
+			jobs <- room
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// Fetch the readings of a Home Coach once the rate limiter allows it
+func fetchReadings(ctx context.Context, config *backend.Config, limiter *rate.Limiter, accessToken string, macID string) (map[string]float64, error) {
+	if err := limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+
+	homeCoachData := NetatmoHomeCoachData{}
+	resp, err := config.RestyClient.R().
+		SetContext(ctx).
+		EnableGenerateCurlOnDebug().
+		SetHeader("Authorization", "Bearer "+accessToken).
+		SetQueryParam("device_id", macID).
+		SetResult(&homeCoachData).
+		Get("https://api.netatmo.com/api/gethomecoachsdata")
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError() {
+		return nil, fmt.Errorf("%s %s", resp.Status(), string(resp.Body()))
+	}
+	slog.Debug("Home Coach Data", "device", macID, "data", homeCoachData)
+
+	if len(homeCoachData.Body.Devices) == 0 {
+		return nil, fmt.Errorf("no data for device %s", macID)
+	}
+	return homeCoachData.Body.Devices[0].DashboardData.readings(), nil
+}
@@ -0,0 +1,108 @@
+package netatmo
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/knadh/koanf/v2"
+
+	"github.com/venkytv/homemon/backend"
+)
+
+// Rooms in each group, keyed by group name
+type roomGroups map[string][]string
+
+// Load the room groups under "groups". Each group is a list of rooms from
+// mac-ids and must not share a name with a room.
+func loadGroups(k *koanf.Koanf, rooms []string) (roomGroups, error) {
+	groups := make(roomGroups)
+	if err := k.Unmarshal("groups", &groups); err != nil {
+		return nil, fmt.Errorf("groups: %w", err)
+	}
+	for group, members := range groups {
+		if slices.Contains(rooms, group) {
+			return nil, fmt.Errorf("group %s has the same name as a room", group)
+		}
+		if len(members) == 0 {
+			return nil, fmt.Errorf("group %s has no rooms", group)
+		}
+		for _, room := range members {
+			if !slices.Contains(rooms, room) {
+				return nil, fmt.Errorf("group %s: unknown room: %s", group, room)
+			}
+		}
+	}
+	return groups, nil
+}
+
+// Publish the aggregate readings of each group as raw metrics, and a group
+// metric carrying the highest priority metric of its rooms, or the ok
+// metric if none of them has one. Rooms without a current reading are left
+// out of the aggregates.
+func publishGroups(ctx context.Context, config *backend.Config, groups roomGroups, okMetric *okConfig, schedule *pollSchedule, readings map[string]map[string]float64, roomMetrics map[string]backend.Metric) {
+	for group, members := range groups {
+		if config.RawSinks != nil && config.RawSinks.Len() > 0 {
+			for _, q := range quantities {
+				var values []float64
+				for _, room := range members {
+					if value, ok := readings[room][q.key]; ok {
+						values = append(values, value)
+					}
+				}
+				if len(values) == 0 {
+					continue
+				}
+				var sum float64
+				for _, value := range values {
+					sum += value
+				}
+				aggregates := map[string]float64{
+					"min":  slices.Min(values),
+					"max":  slices.Max(values),
+					"mean": sum / float64(len(values)),
+				}
+				for suffix, value := range aggregates {
+					rawMetric := backend.RawMetric{
+						Name:     q.rawName + "_" + suffix,
+						DeviceID: DeviceID,
+						Location: group,
+						Value:    value,
+					}
+					slog.Info("Publishing group raw metric", "metric", rawMetric)
+					if err := config.RawSinks.Publish(ctx, rawMetric); err != nil {
+						slog.Error("Error publishing raw metric", "error", err)
+					}
+				}
+			}
+		}
+
+		var top *backend.Metric
+		for _, room := range members {
+			metric, ok := roomMetrics[room]
+			if ok && (top == nil || metric.Priority > top.Priority) {
+				top = &metric
+			}
+		}
+		name := "group:" + group
+		if top == nil {
+			if okMetric == nil {
+				clearMetric(ctx, config, name)
+				continue
+			}
+			top = &backend.Metric{Name: name, Priority: okMetric.Priority, Colour: okMetric.Colour, Message: "ok"}
+		}
+		metric := backend.MetricGenerator(name, schedule.ttl(members...))(top.Priority, top.Colour)
+		metric.Value = top.Value
+		metric.Unit = top.Unit
+		reason := top.Message
+		if reason == "" {
+			reason = top.Name
+		}
+		metric.Message = group + ": " + reason
+		metric.Source = DeviceID
+		slog.Info("Publishing group metric", "metric", metric, "from", top.Name)
+		publishMetric(ctx, config, metric)
+	}
+}
@@ -0,0 +1,135 @@
+package netatmo
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+
+	"github.com/venkytv/homemon/backend"
+)
+
+const (
+	AlertRawMetricName = "alert"
+	alertOn            = "ON"
+	alertOff           = "OFF"
+)
+
+type haDevice struct {
+	Identifiers  []string   `json:"identifiers"`
+	Connections  [][]string `json:"connections,omitempty"`
+	Name         string     `json:"name"`
+	Manufacturer string     `json:"manufacturer"`
+	Model        string     `json:"model"`
+}
+
+type haDiscoveryPayload struct {
+	Name              string   `json:"name"`
+	UniqueID          string   `json:"unique_id"`
+	DeviceClass       string   `json:"device_class,omitempty"`
+	UnitOfMeasurement string   `json:"unit_of_measurement,omitempty"`
+	StateClass        string   `json:"state_class,omitempty"`
+	StateTopic        string   `json:"state_topic"`
+	ValueTemplate     string   `json:"value_template,omitempty"`
+	PayloadOn         string   `json:"payload_on,omitempty"`
+	PayloadOff        string   `json:"payload_off,omitempty"`
+	Device            haDevice `json:"device"`
+}
+
+// Publish Home Assistant MQTT discovery payloads for every room: one sensor
+// per quantity and a binary sensor which is on while any of the room's
+// readings is in a configured range
+func publishDiscovery(ctx context.Context, config *backend.Config, macIdMap map[string]string) error {
+	prefix := config.HADiscoveryPrefix
+	for room, macID := range macIdMap {
+		objectID := strings.ReplaceAll(DeviceID+"_"+room, "-", "_")
+		device := haDevice{
+			Identifiers:  []string{objectID},
+			Connections:  [][]string{{"mac", macID}},
+			Name:         displayName(room),
+			Manufacturer: "Netatmo",
+			Model:        "Smart Indoor Air Quality Monitor",
+		}
+
+		payloads := make(map[string]haDiscoveryPayload)
+		for _, q := range quantities {
+			stateTopic, err := config.MQTTPublisher.RawTopic(backend.RawMetric{
+				Name:     q.rawName,
+				DeviceID: DeviceID,
+				Location: room,
+			})
+			if err != nil {
+				return err
+			}
+			payloads[prefix+"/sensor/"+objectID+"_"+q.key+"/config"] = haDiscoveryPayload{
+				Name:              q.label,
+				UniqueID:          objectID + "_" + q.key,
+				DeviceClass:       q.deviceClass,
+				UnitOfMeasurement: q.unit,
+				StateClass:        "measurement",
+				StateTopic:        stateTopic,
+				ValueTemplate:     "{{ value_json.value }}",
+				Device:            device,
+			}
+		}
+
+		alertTopic, err := alertTopic(config, room)
+		if err != nil {
+			return err
+		}
+		payloads[prefix+"/binary_sensor/"+objectID+"_alert/config"] = haDiscoveryPayload{
+			Name:        "Alert",
+			UniqueID:    objectID + "_alert",
+			DeviceClass: "problem",
+			StateTopic:  alertTopic,
+			PayloadOn:   alertOn,
+			PayloadOff:  alertOff,
+			Device:      device,
+		}
+
+		for topic, payload := range payloads {
+			data, err := json.Marshal(payload)
+			if err != nil {
+				return err
+			}
+			slog.Debug("Publishing Home Assistant discovery", "topic", topic)
+			// Discovery payloads are retained so Home Assistant picks them
+			// up after a restart
+			if err := config.MQTTPublisher.PublishMessage(ctx, topic, data, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Publish the alert state of a room
+func publishAlertState(ctx context.Context, config *backend.Config, room string, active bool) error {
+	topic, err := alertTopic(config, room)
+	if err != nil {
+		return err
+	}
+	state := alertOff
+	if active {
+		state = alertOn
+	}
+	return config.MQTTPublisher.PublishMessage(ctx, topic, []byte(state), true)
+}
+
+// The alert state topic is the raw topic of a pseudo "alert" metric
+func alertTopic(config *backend.Config, room string) (string, error) {
+	return config.MQTTPublisher.RawTopic(backend.RawMetric{
+		Name:     AlertRawMetricName,
+		DeviceID: DeviceID,
+		Location: room,
+	})
+}
+
+// Turn a room key like "living-room" into "Living room"
+func displayName(room string) string {
+	name := strings.NewReplacer("-", " ", "_", " ").Replace(room)
+	if len(name) == 0 {
+		return name
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
@@ -0,0 +1,124 @@
+package netatmo
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+
+	"github.com/knadh/koanf/v2"
+
+	"github.com/venkytv/homemon/rules"
+)
+
+// Message templates used when the config does not set one
+const (
+	defaultMessage     = `{{.Label}} in {{.Room}} is {{printf "%.1f" .Value}}{{with .Unit}} {{.}}{{end}}`
+	defaultRuleMessage = `{{.Rule}}{{with .Room}} in {{.}}{{end}}: {{.When}}`
+)
+
+// Data available to range message templates
+type messageData struct {
+	Room     string
+	Quantity string
+	Label    string
+	Value    float64
+	Unit     string
+	Priority int
+	Colour   string
+}
+
+// Data available to rule message templates
+type ruleMessageData struct {
+	Rule     string
+	Room     string
+	When     string
+	Priority int
+	Colour   string
+}
+
+// Message templates keyed by room and then quantity, and by rule
+type messageSet struct {
+	ranges map[string]map[string]*template.Template
+	rules  map[string]*template.Template
+}
+
+// Load the message templates. Templates under messages.<quantity> apply to
+// every room unless rooms.<room>.messages.<quantity> is set.
+func loadMessages(k *koanf.Koanf, rooms []string, ruleList []rules.Rule) (*messageSet, error) {
+	set := &messageSet{
+		ranges: make(map[string]map[string]*template.Template),
+		rules:  make(map[string]*template.Template),
+	}
+	for _, room := range rooms {
+		set.ranges[room] = make(map[string]*template.Template)
+		for _, q := range quantities {
+			text := defaultMessage
+			for _, path := range []string{"messages." + q.key, "rooms." + room + ".messages." + q.key} {
+				if k.Exists(path) {
+					text = k.String(path)
+				}
+			}
+			tmpl, err := parseMessage(q.key, text, messageData{})
+			if err != nil {
+				return nil, fmt.Errorf("message for %s in %s: %w", q.key, room, err)
+			}
+			set.ranges[room][q.key] = tmpl
+		}
+	}
+	for _, rule := range ruleList {
+		text := rule.Message
+		if text == "" {
+			text = defaultRuleMessage
+		}
+		tmpl, err := parseMessage(rule.Name, text, ruleMessageData{})
+		if err != nil {
+			return nil, fmt.Errorf("message for rule %s: %w", rule.Name, err)
+		}
+		set.rules[rule.Name] = tmpl
+	}
+	return set, nil
+}
+
+// Parse a message template and check that it runs against sample data
+func parseMessage(name string, text string, sample interface{}) (*template.Template, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(&bytes.Buffer{}, sample); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+func renderMessage(tmpl *template.Template, data interface{}) string {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return err.Error()
+	}
+	return buf.String()
+}
+
+// Message for a range metric of quantity q in room
+func (m *messageSet) rangeMessage(room string, q quantity, value float64, priority int, colour string) string {
+	return renderMessage(m.ranges[room][q.key], messageData{
+		Room:     room,
+		Quantity: q.key,
+		Label:    q.label,
+		Value:    value,
+		Unit:     q.unit,
+		Priority: priority,
+		Colour:   colour,
+	})
+}
+
+// Message for a rule metric
+func (m *messageSet) ruleMessage(result rules.Result) string {
+	return renderMessage(m.rules[result.Rule], ruleMessageData{
+		Rule:     result.Rule,
+		Room:     result.Room,
+		When:     result.When,
+		Priority: result.Priority,
+		Colour:   result.Colour,
+	})
+}
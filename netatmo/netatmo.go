@@ -2,6 +2,7 @@ package netatmo
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
@@ -10,11 +11,10 @@ import (
 	"time"
 
 	"github.com/go-resty/resty/v2"
-	"github.com/knadh/koanf/parsers/yaml"
-	"github.com/knadh/koanf/providers/file"
 	"github.com/knadh/koanf/v2"
 
 	"github.com/venkytv/homemon/backend"
+	"github.com/venkytv/homemon/rules"
 )
 
 const (
@@ -32,18 +32,33 @@ type RefreshTokenResponse struct {
 type NetatmoHomeCoachData struct {
 	Body struct {
 		Devices []struct {
-			DashboardData struct {
-				Temperature float64 `json:"Temperature"`
-				CO2         int     `json:"CO2"`
-				Humidity    int     `json:"Humidity"`
-				Noise       int     `json:"Noise"`
-				Pressure    float64 `json:"Pressure"`
-			} `json:"dashboard_data"`
+			DashboardData DashboardData `json:"dashboard_data"`
 		} `json:"devices"`
 	} `json:"body"`
 }
 
-func RecordMetrics(ctx context.Context, config *backend.Config) {
+type DashboardData struct {
+	Temperature float64 `json:"Temperature"`
+	CO2         int     `json:"CO2"`
+	Humidity    int     `json:"Humidity"`
+	Noise       int     `json:"Noise"`
+	Pressure    float64 `json:"Pressure"`
+}
+
+// Readings keyed by quantity
+func (d DashboardData) readings() map[string]float64 {
+	return map[string]float64{
+		"temperature": d.Temperature,
+		"humidity":    float64(d.Humidity),
+		"co2":         float64(d.CO2),
+		"noise":       float64(d.Noise),
+		"pressure":    d.Pressure,
+	}
+}
+
+// RecordMetrics polls the Home Coaches and publishes their metrics until
+// ctx is done. Polling settings set in flags override the config.
+func RecordMetrics(ctx context.Context, config *backend.Config, flags Polling) {
 	// Get the access token
 	refreshTokenFile := path.Join(config.ConfigDir, NetatmoRefreshTokenFile)
 	accessToken, expiresIn, err := getAccessToken(ctx, config.RestyClient, refreshTokenFile)
@@ -54,31 +69,105 @@ func RecordMetrics(ctx context.Context, config *backend.Config) {
 	slog.Debug("Access Token", "expiresIn", expiresIn)
 
 	// Load mac IDs
-	configFile := path.Join(config.ConfigDir, NetatmoConfigFile)
-	var k = koanf.New(".")
-
-	if err := k.Load(file.Provider(configFile), yaml.Parser()); err != nil {
+	k, err := loadConfig(config.ConfigDir)
+	if err != nil {
 		slog.Error("Error loading config file", "error", err)
 		os.Exit(1)
 	}
 
+	// Compile the alert rules
+	var ruleList []rules.Rule
+	if err := k.Unmarshal("rules", &ruleList); err != nil {
+		slog.Error("Error loading rules", "error", err)
+		os.Exit(1)
+	}
+	engine, err := rules.NewEngine(ruleList, roomNames(k.MustStringMap("mac-ids")), quantityKeys())
+	if err != nil {
+		slog.Error("Error compiling rules", "error", err)
+		os.Exit(1)
+	}
+	ranges, err := loadRanges(k, roomNames(k.MustStringMap("mac-ids")))
+	if err != nil {
+		slog.Error("Error loading metric ranges", "error", err)
+		os.Exit(1)
+	}
+	groups, err := loadGroups(k, roomNames(k.MustStringMap("mac-ids")))
+	if err != nil {
+		slog.Error("Error loading room groups", "error", err)
+		os.Exit(1)
+	}
+	messages, err := loadMessages(k, roomNames(k.MustStringMap("mac-ids")), ruleList)
+	if err != nil {
+		slog.Error("Error loading message templates", "error", err)
+		os.Exit(1)
+	}
+	okMetric, err := loadOK(k)
+	if err != nil {
+		slog.Error("Error loading ok metric", "error", err)
+		os.Exit(1)
+	}
+	schedule, err := loadPolling(k, roomNames(k.MustStringMap("mac-ids")), flags)
+	if err != nil {
+		slog.Error("Error loading polling settings", "error", err)
+		os.Exit(1)
+	}
+	state := &collectorState{
+		engine:   engine,
+		deriver:  newDeriver(),
+		ranges:   ranges,
+		groups:   groups,
+		messages: messages,
+		okMetric: okMetric,
+		schedule: schedule,
+
+		roomReadings: make(map[string]timedReadings),
+		roomMetrics:  make(map[string]backend.Metric),
+		activeRules:  make(map[string]bool),
+	}
+	// Readings stop counting for rules once a room's metrics would expire
+	for _, room := range roomNames(k.MustStringMap("mac-ids")) {
+		engine.SetTTL(room, schedule.ttl(room))
+	}
+
+	// Announce the rooms to Home Assistant
+	if config.MQTTPublisher != nil && len(config.HADiscoveryPrefix) > 0 {
+		if err := publishDiscovery(ctx, config, k.MustStringMap("mac-ids")); err != nil {
+			slog.Error("Error publishing Home Assistant discovery", "error", err)
+		}
+	}
+
+	// Apply the request timeout to every Netatmo API request
+	config.RestyClient.SetTimeout(schedule.requestTimeout)
+
 	// Record the initial metrics
-	recordMetricsRoutine(ctx, config, k, accessToken)
+	recordMetricsRoutine(ctx, config, k, state, accessToken, schedule.due(time.Now()))
 
-	// Start the ticker to record metrics
-	metricsTicker := time.NewTicker(3 * time.Minute)
+	// Start the timer to record metrics when the next room is due
+	metricsTimer := time.NewTimer(schedule.untilNext(time.Now()))
 
 	// Start the ticker to refresh the access token
 	accessTokenTicker := time.NewTicker(time.Duration(expiresIn-1800) * time.Second)
 
 	// Start the ticker to run the cleanup routine
-	cleanupTicker := time.NewTicker(15 * time.Second)
+	cleanupTicker := time.NewTicker(schedule.cleanup)
+
+	defer metricsTimer.Stop()
+	defer accessTokenTicker.Stop()
+	defer cleanupTicker.Stop()
 
 	for {
 		select {
-		case <-metricsTicker.C:
-			slog.Debug("Recording metrics")
-			recordMetricsRoutine(ctx, config, k, accessToken)
+		case <-ctx.Done():
+			slog.Info("Stopped recording metrics")
+			return
+		case <-metricsTimer.C:
+			rooms := schedule.due(time.Now())
+			slog.Debug("Recording metrics", "rooms", rooms)
+			recordMetricsRoutine(ctx, config, k, state, accessToken, rooms)
+			if config.RawSinks != nil {
+				slog.Debug("Raw sink stats", "stats", config.RawSinks.Stats())
+			}
+			metricsTimer.Reset(schedule.untilNext(time.Now()))
 		case <-accessTokenTicker.C:
 			slog.Info("Refreshing access token")
 			accessToken, expiresIn, err = getAccessToken(ctx, config.RestyClient, refreshTokenFile)
@@ -93,148 +182,193 @@ func RecordMetrics(ctx context.Context, config *backend.Config) {
 	}
 }
 
-func recordMetricsRoutine(ctx context.Context, config *backend.Config, k *koanf.Koanf, accessToken string) {
+// State kept by the collector between polls
+type collectorState struct {
+	engine   *rules.Engine
+	deriver  *deriver
+	ranges   rangeSet
+	groups   roomGroups
+	messages *messageSet
+	okMetric *okConfig
+	schedule *pollSchedule
+	// Latest readings and highest priority metric of each room, kept until
+	// they expire as rooms may be polled at different intervals
+	roomReadings map[string]timedReadings
+	roomMetrics  map[string]backend.Metric
+	// Rule metrics published while their rule was active
+	activeRules map[string]bool
+}
+
+// Readings of a room and when they expire
+type timedReadings struct {
+	values  map[string]float64
+	expires time.Time
+}
+
+// Poll the given rooms and publish their metrics, then evaluate the rules
+// and room groups
+func recordMetricsRoutine(ctx context.Context, config *backend.Config, k *koanf.Koanf, state *collectorState, accessToken string, rooms []string) {
 	// Load mac IDs
 	macIdMap := k.MustStringMap("mac-ids")
 
-	// Load metric ranges
-	var humitidyRanges, temperatureRanges, co2Ranges, noiseRanges []backend.Range
-	k.Unmarshal("metrics.humidity", &humitidyRanges)
-	k.Unmarshal("metrics.temperature", &temperatureRanges)
-	k.Unmarshal("metrics.co2", &co2Ranges)
-	k.Unmarshal("metrics.noise", &noiseRanges)
-
-	// Build metrics generators for each room
-	var humidityMetricGeneratorMap = make(map[string]func(int, string) backend.Metric)
-	var temperatureMetricGeneratorMap = make(map[string]func(int, string) backend.Metric)
-	var co2MetricGeneratorMap = make(map[string]func(int, string) backend.Metric)
-	var noiseMetricGeneratorMap = make(map[string]func(int, string) backend.Metric)
-
-	for room, _ := range macIdMap {
-		humidityMetricGeneratorMap[room] = backend.MetricGenerator("humidity:"+room, 5*time.Minute)
-		temperatureMetricGeneratorMap[room] = backend.MetricGenerator("temperature:"+room, 5*time.Minute)
-		co2MetricGeneratorMap[room] = backend.MetricGenerator("co2:"+room, 5*time.Minute)
-		noiseMetricGeneratorMap[room] = backend.MetricGenerator("noise:"+room, 5*time.Minute)
-	}
-
-	for room, mac_id := range macIdMap {
-
-		homeCoachData := NetatmoHomeCoachData{}
-		resp, err := config.RestyClient.R().
-			SetContext(ctx).
-			EnableGenerateCurlOnDebug().
-			SetHeader("Authorization", "Bearer "+accessToken).
-			SetQueryParam("device_id", mac_id).
-			SetResult(&homeCoachData).
-			Get("https://api.netatmo.com/api/gethomecoachsdata")
-		if err != nil {
-			slog.Error("Error getting home coach data", "error", err)
-			os.Exit(1)
-		}
-		if resp.IsError() {
-			slog.Error("Error getting home coach data", "error", resp.Status()+" "+string(resp.Body()))
-			os.Exit(1)
+	now := time.Now()
+	alertRooms := make(map[string]bool)
+	roomMetrics := state.roomMetrics
+	noteMetric := func(room string, metric backend.Metric) {
+		alertRooms[room] = true
+		if top, ok := roomMetrics[room]; !ok || metric.Priority > top.Priority {
+			roomMetrics[room] = metric
 		}
-		slog.Debug("Home Coach Data", "data", homeCoachData)
+	}
 
-		dashboardData := homeCoachData.Body.Devices[0].DashboardData
+	// Publish each room's metrics as soon as its readings arrive. Rooms
+	// which fail are skipped until their next poll.
+	for result := range fetchRooms(ctx, config, state.schedule, accessToken, macIdMap, rooms) {
+		if result.err != nil {
+			slog.Error("Error getting home coach data", "room", result.room, "error", result.err)
+			continue
+		}
+		room, readings := result.room, result.readings
+		state.deriver.derive(room, now, readings)
+		state.roomReadings[room] = timedReadings{values: readings, expires: now.Add(state.schedule.ttl(room))}
 
 		// Publish raw metrics
-		if config.RawPublisher == nil {
-			slog.Info("Raw publisher not set. Skipping raw metrics")
+		if config.RawSinks == nil || config.RawSinks.Len() == 0 {
+			slog.Info("No raw sinks configured. Skipping raw metrics")
 		} else {
-			rawMetrics := []backend.RawMetric{
-				{
-					Name:     "sensor.environmental.temperature",
-					DeviceID: DeviceID,
-					Location: room,
-					Value:    dashboardData.Temperature,
-				},
-				{
-					Name:     "sensor.environmental.humidity",
-					DeviceID: DeviceID,
-					Location: room,
-					Value:    float64(dashboardData.Humidity),
-				},
-				{
-					Name:     "sensor.environmental.co2",
-					DeviceID: DeviceID,
-					Location: room,
-					Value:    float64(dashboardData.CO2),
-				},
-				{
-					Name:     "sensor.acoustic.noise",
+			for _, q := range quantities {
+				if _, ok := readings[q.key]; !ok {
+					continue
+				}
+				rawMetric := backend.RawMetric{
+					Name:     q.rawName,
 					DeviceID: DeviceID,
 					Location: room,
-					Value:    float64(dashboardData.Noise),
-				},
-			}
-
-			for _, rawMetric := range rawMetrics {
+					Value:    readings[q.key],
+				}
 				slog.Info("Publishing raw metric", "metric", rawMetric)
-				err = config.RawPublisher.Publish(ctx, rawMetric)
-				if err != nil {
+				if err := config.RawSinks.Publish(ctx, rawMetric); err != nil {
 					slog.Error("Error publishing raw metric", "error", err)
 				}
 			}
 		}
 
 		// Generate metrics
+		alertRooms[room] = false
+		delete(roomMetrics, room)
+		for _, q := range quantities {
+			value, ok := readings[q.key]
+			if !ok {
+				continue
+			}
+			state.engine.Observe(room, q.key, now, value)
 
-		// Humidity
-		for _, metricRange := range humitidyRanges {
-			if float64(dashboardData.Humidity) >= metricRange.From && float64(dashboardData.Humidity) < metricRange.To {
-				humidityMetric := humidityMetricGeneratorMap[room](metricRange.Priority, metricRange.Colour)
-				slog.Info("Publishing metric", "humidity", humidityMetric, "current", dashboardData.Humidity)
-				err = config.Publisher.Publish(ctx, humidityMetric)
-				if err != nil {
-					slog.Error("Error publishing metric", "error", err)
+			// Quantities without ranges are only used by rules and groups,
+			// and their metric names are left alone
+			ranges := state.ranges[room][q.key].Ranges
+			if len(ranges) == 0 {
+				continue
+			}
+			name := MetricName(q.key, room)
+			metricRange, inRange := backend.FindRange(ranges, value, now)
+			if !inRange {
+				if state.okMetric == nil {
+					clearMetric(ctx, config, name)
+					continue
 				}
-				break
+				metricRange = backend.Range{Priority: state.okMetric.Priority, Colour: state.okMetric.Colour}
+			}
+			metric := backend.MetricGenerator(name, state.schedule.ttl(room))(metricRange.Priority, metricRange.Colour)
+			metric.Value = &value
+			metric.Unit = q.unit
+			metric.Message = state.messages.rangeMessage(room, q, value, metric.Priority, metric.Colour)
+			metric.Source = DeviceID
+			slog.Info("Publishing metric", q.key, metric, "current", value)
+			if publishMetric(ctx, config, metric) && inRange {
+				noteMetric(room, metric)
 			}
 		}
+	}
 
-		// Temperature
-		for _, metricRange := range temperatureRanges {
-			if float64(dashboardData.Temperature) >= metricRange.From && float64(dashboardData.Temperature) < metricRange.To {
-				temperatureMetric := temperatureMetricGeneratorMap[room](metricRange.Priority, metricRange.Colour)
-				slog.Info("Publishing metric", "temperature", temperatureMetric, "current", dashboardData.Temperature)
-				err = config.Publisher.Publish(ctx, temperatureMetric)
-				if err != nil {
-					slog.Error("Error publishing metric", "error", err)
-				}
-				break
+	// Evaluate rules once every room has been read
+	for _, result := range state.engine.Evaluate(now) {
+		if !result.Active {
+			// Clear rule metrics as soon as the rule stops holding
+			if state.activeRules[result.Name] {
+				clearMetric(ctx, config, result.Name)
+				delete(state.activeRules, result.Name)
 			}
+			continue
 		}
+		state.activeRules[result.Name] = true
+		metric := backend.MetricGenerator(result.Name, state.schedule.ttl())(result.Priority, result.Colour)
+		metric.Message = state.messages.ruleMessage(result)
+		metric.Source = DeviceID
+		slog.Info("Publishing rule metric", "metric", metric)
+		if publishMetric(ctx, config, metric) && result.Room != "" {
+			noteMetric(result.Room, metric)
+		}
+	}
 
-		// CO2
-		for _, metricRange := range co2Ranges {
-			if float64(dashboardData.CO2) >= metricRange.From && float64(dashboardData.CO2) < metricRange.To {
-				co2Metric := co2MetricGeneratorMap[room](metricRange.Priority, metricRange.Colour)
-				slog.Info("Publishing metric", "co2", co2Metric, "current", dashboardData.CO2)
-				err = config.Publisher.Publish(ctx, co2Metric)
-				if err != nil {
-					slog.Error("Error publishing metric", "error", err)
-				}
-				break
-			}
+	// Aggregate the groups over the latest readings of every room, leaving
+	// out rooms whose readings and metrics have expired
+	readings := make(map[string]map[string]float64)
+	for room, r := range state.roomReadings {
+		if !r.expires.After(now) {
+			delete(state.roomReadings, room)
+			continue
+		}
+		readings[room] = r.values
+	}
+	for room, metric := range roomMetrics {
+		if !metric.TTL.After(now) {
+			delete(roomMetrics, room)
 		}
+	}
+	publishGroups(ctx, config, state.groups, state.okMetric, state.schedule, readings, roomMetrics)
 
-		// Noise
-		for _, metricRange := range noiseRanges {
-			if float64(dashboardData.Noise) >= metricRange.From && float64(dashboardData.Noise) < metricRange.To {
-				noiseMetric := noiseMetricGeneratorMap[room](metricRange.Priority, metricRange.Colour)
-				slog.Info("Publishing metric", "noise", noiseMetric, "current", dashboardData.Noise)
-				err = config.Publisher.Publish(ctx, noiseMetric)
-				if err != nil {
-					slog.Error("Error publishing metric", "error", err)
-				}
-				break
+	if config.MQTTPublisher != nil {
+		for room, alertActive := range alertRooms {
+			if err := publishAlertState(ctx, config, room, alertActive); err != nil {
+				slog.Error("Error publishing alert state", "error", err)
 			}
 		}
 	}
 }
 
+// Publish a status metric, reporting false if it failed or a snooze,
+// acknowledgement or override held it back
+func publishMetric(ctx context.Context, config *backend.Config, metric backend.Metric) bool {
+	err := config.PublishMetric(ctx, metric)
+	if errors.Is(err, backend.ErrMetricSuppressed) {
+		slog.Info("Metric suppressed", "metric", metric.Name)
+		return false
+	}
+	if errors.Is(err, backend.ErrMetricOverridden) {
+		slog.Info("Metric overridden", "metric", metric.Name)
+		return false
+	}
+	if err != nil {
+		slog.Error("Error publishing metric", "error", err)
+		return false
+	}
+	return true
+}
+
+// Delete a metric whose reading no longer falls in any range or whose rule
+// no longer holds, leaving overrides in place
+func clearMetric(ctx context.Context, config *backend.Config, name string) {
+	err := config.DeleteMetric(ctx, name)
+	if errors.Is(err, backend.ErrMetricNotFound) || errors.Is(err, backend.ErrMetricOverridden) {
+		return
+	}
+	if err != nil {
+		slog.Error("Error clearing metric", "metric", name, "error", err)
+		return
+	}
+	slog.Info("Cleared metric", "metric", name)
+}
+
 // Get a new access token using the refresh token in file
 func getAccessToken(ctx context.Context, client *resty.Client, refreshTokenFile string) (string, int, error) {
 	refreshToken, err := readRefreshTokenFromFile(refreshTokenFile)
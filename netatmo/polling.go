@@ -0,0 +1,200 @@
+package netatmo
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/knadh/koanf/v2"
+	"golang.org/x/time/rate"
+)
+
+// Polling settings used when neither the config nor the flags set them
+const (
+	DefaultPollInterval    = 3 * time.Minute
+	DefaultMetricTTL       = 5 * time.Minute
+	DefaultCleanupInterval = 15 * time.Second
+	DefaultWorkers         = 4
+	DefaultRequestTimeout  = 30 * time.Second
+
+	// Netatmo allows 50 requests every 10 seconds per user
+	DefaultRateLimit  = 50
+	DefaultRatePeriod = 10 * time.Second
+)
+
+// Rooms due within this long of each other are polled together
+const pollSlack = time.Second
+
+// Polling settings of the collector. Zero values are unset.
+type Polling struct {
+	Interval        time.Duration // Time between polls of each room
+	TTL             time.Duration // Time to live of the published metrics
+	CleanupInterval time.Duration // Time between cleanups of expired metrics
+	Workers         int           // Devices polled at once
+	RequestTimeout  time.Duration // Timeout of each Netatmo API request
+	RateLimit       int           // Requests allowed every RatePeriod
+	RatePeriod      time.Duration
+}
+
+// Poll interval and metric TTL of a room, and when it is next due
+type roomPolling struct {
+	interval time.Duration
+	ttl      time.Duration
+	next     time.Time
+}
+
+// When each room is polled, and how the polls are spread over the API
+type pollSchedule struct {
+	cleanup        time.Duration
+	rooms          map[string]*roomPolling
+	workers        int
+	requestTimeout time.Duration
+	limiter        *rate.Limiter // Shared by every poll
+}
+
+// Load the polling settings under "polling", overridden by the flags, and
+// the room settings under rooms.<room>.polling. A room which only sets its
+// interval keeps the margin between the global interval and TTL, so that
+// its metrics don't expire between polls.
+func loadPolling(k *koanf.Koanf, rooms []string, flags Polling) (*pollSchedule, error) {
+	global := Polling{
+		Interval:        DefaultPollInterval,
+		TTL:             DefaultMetricTTL,
+		CleanupInterval: DefaultCleanupInterval,
+		Workers:         DefaultWorkers,
+		RequestTimeout:  DefaultRequestTimeout,
+		RateLimit:       DefaultRateLimit,
+		RatePeriod:      DefaultRatePeriod,
+	}
+	settings := []struct {
+		key   string
+		value *time.Duration
+		flag  time.Duration
+	}{
+		{"interval", &global.Interval, flags.Interval},
+		{"ttl", &global.TTL, flags.TTL},
+		{"cleanup-interval", &global.CleanupInterval, flags.CleanupInterval},
+		{"request-timeout", &global.RequestTimeout, flags.RequestTimeout},
+		{"rate-period", &global.RatePeriod, flags.RatePeriod},
+	}
+	for _, setting := range settings {
+		if path := "polling." + setting.key; k.Exists(path) {
+			*setting.value = k.Duration(path)
+		}
+		if setting.flag != 0 {
+			*setting.value = setting.flag
+		}
+		if *setting.value <= 0 {
+			return nil, fmt.Errorf("polling %s must be positive", setting.key)
+		}
+	}
+	counts := []struct {
+		key   string
+		value *int
+		flag  int
+	}{
+		{"workers", &global.Workers, flags.Workers},
+		{"rate-limit", &global.RateLimit, flags.RateLimit},
+	}
+	for _, count := range counts {
+		if path := "polling." + count.key; k.Exists(path) {
+			*count.value = k.Int(path)
+		}
+		if count.flag != 0 {
+			*count.value = count.flag
+		}
+		if *count.value <= 0 {
+			return nil, fmt.Errorf("polling %s must be positive", count.key)
+		}
+	}
+	if global.TTL <= global.Interval {
+		return nil, fmt.Errorf("metric TTL %s must be longer than the poll interval %s", global.TTL, global.Interval)
+	}
+
+	schedule := &pollSchedule{
+		cleanup:        global.CleanupInterval,
+		rooms:          make(map[string]*roomPolling),
+		workers:        global.Workers,
+		requestTimeout: global.RequestTimeout,
+		// Allow the whole limit at once, refilled evenly over the period
+		limiter: rate.NewLimiter(rate.Every(global.RatePeriod/time.Duration(global.RateLimit)), global.RateLimit),
+	}
+	for _, room := range rooms {
+		r := &roomPolling{interval: global.Interval, ttl: global.TTL}
+		path := "rooms." + room + ".polling."
+		if k.Exists(path + "interval") {
+			r.interval = k.Duration(path + "interval")
+			r.ttl = r.interval + global.TTL - global.Interval
+		}
+		if k.Exists(path + "ttl") {
+			r.ttl = k.Duration(path + "ttl")
+		}
+		if r.interval <= 0 {
+			return nil, fmt.Errorf("%sinterval must be positive", path)
+		}
+		if r.ttl <= r.interval {
+			return nil, fmt.Errorf("metric TTL %s of %s must be longer than its poll interval %s", r.ttl, room, r.interval)
+		}
+		schedule.rooms[room] = r
+	}
+	return schedule, nil
+}
+
+// MetricTTL returns the TTL the collector gives the metrics of a room, or
+// polling.ttl if room is empty
+func MetricTTL(configDir string, room string) (time.Duration, error) {
+	k, err := loadConfig(configDir)
+	if err != nil {
+		return 0, fmt.Errorf("error loading config file: %w", err)
+	}
+	schedule, err := loadPolling(k, []string{room}, Polling{})
+	if err != nil {
+		return 0, err
+	}
+	return schedule.ttl(room), nil
+}
+
+// Rooms due to be polled at now, moving them on to their next poll. Rooms
+// which have never been polled are due straight away.
+func (s *pollSchedule) due(now time.Time) []string {
+	var rooms []string
+	for room, r := range s.rooms {
+		if r.next.After(now.Add(pollSlack)) {
+			continue
+		}
+		rooms = append(rooms, room)
+		if r.next.IsZero() {
+			r.next = now
+		}
+		// Skip polls missed while a poll took too long
+		for !r.next.After(now) {
+			r.next = r.next.Add(r.interval)
+		}
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// Time until the next room is due
+func (s *pollSchedule) untilNext(now time.Time) time.Duration {
+	var next time.Time
+	for _, r := range s.rooms {
+		if next.IsZero() || r.next.Before(next) {
+			next = r.next
+		}
+	}
+	return max(0, next.Sub(now))
+}
+
+// Longest metric TTL of the given rooms, or of every room if none are
+// given, for metrics which cover several rooms
+func (s *pollSchedule) ttl(rooms ...string) time.Duration {
+	var ttl time.Duration
+	for room, r := range s.rooms {
+		if len(rooms) == 0 || slices.Contains(rooms, room) {
+			ttl = max(ttl, r.ttl)
+		}
+	}
+	return ttl
+}
@@ -0,0 +1,70 @@
+package netatmo
+
+// Quantity reported by the Home Coach
+type quantity struct {
+	key         string // Key under "metrics" in the config
+	rawName     string // Name of the raw metric
+	label       string
+	deviceClass string // Home Assistant device class
+	unit        string
+}
+
+var quantities = []quantity{
+	{"temperature", "sensor.environmental.temperature", "Temperature", "temperature", "°C"},
+	{"humidity", "sensor.environmental.humidity", "Humidity", "humidity", "%"},
+	{"co2", "sensor.environmental.co2", "CO2", "carbon_dioxide", "ppm"},
+	{"noise", "sensor.acoustic.noise", "Noise", "sound_pressure", "dB"},
+	{"pressure", "sensor.environmental.pressure", "Pressure", "atmospheric_pressure", "mbar"},
+
+	// Derived quantities, see derived.go
+	{"dewpoint", "sensor.environmental.dewpoint", "Dew point", "temperature", "°C"},
+	{"absolute-humidity", "sensor.environmental.absolute_humidity", "Absolute humidity", "", "g/m³"},
+	{"heat-index", "sensor.environmental.heat_index", "Heat index", "temperature", "°C"},
+	{"temperature-rate", "sensor.environmental.temperature_rate", "Temperature change", "", "°C/h"},
+	{"humidity-rate", "sensor.environmental.humidity_rate", "Humidity change", "", "%/h"},
+	{"co2-rate", "sensor.environmental.co2_rate", "CO2 change", "", "ppm/h"},
+}
+
+// Keys of all quantities, as used in rules
+func quantityKeys() []string {
+	keys := make([]string, 0, len(quantities))
+	for _, q := range quantities {
+		keys = append(keys, q.key)
+	}
+	return keys
+}
+
+// Rooms configured in mac-ids
+func roomNames(macIdMap map[string]string) []string {
+	rooms := make([]string, 0, len(macIdMap))
+	for room := range macIdMap {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// Quantity is a reading of the Home Coach as shown by dashboards
+type Quantity struct {
+	Key     string
+	RawName string // Name of the raw metric
+	Label   string
+	Unit    string
+}
+
+// MeasuredQuantities returns the quantities read from the Home Coach, as
+// opposed to derived ones
+func MeasuredQuantities() []Quantity {
+	measured := DashboardData{}.readings()
+	var out []Quantity
+	for _, q := range quantities {
+		if _, ok := measured[q.key]; ok {
+			out = append(out, Quantity{Key: q.key, RawName: q.rawName, Label: q.label, Unit: q.unit})
+		}
+	}
+	return out
+}
+
+// MetricName returns the name of the status metric of a quantity in a room
+func MetricName(key string, room string) string {
+	return key + ":" + room
+}
@@ -0,0 +1,177 @@
+package netatmo
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/knadh/koanf/v2"
+
+	"github.com/venkytv/homemon/backend"
+)
+
+// How a room's ranges combine with the global ranges for a quantity
+const (
+	MergeInherit = "inherit" // No room ranges, the global ranges apply
+	MergeReplace = "replace" // Only the room ranges apply
+	MergePrepend = "prepend" // Room ranges are checked before the global ones
+	MergeAppend  = "append"  // Room ranges are checked after the global ones
+)
+
+// Effective ranges of a quantity in a room
+type roomRanges struct {
+	Merge  string
+	Ranges []backend.Range
+	// "room" or "global" for each range
+	Sources []string
+}
+
+// Ranges for every room, keyed by room and then quantity
+type rangeSet map[string]map[string]roomRanges
+
+// Room overrides written as a map rather than a plain list
+type roomOverride struct {
+	Merge  string          `koanf:"merge"`
+	Ranges []backend.Range `koanf:"ranges"`
+}
+
+// Load the ranges for every room. Rooms inherit the global ranges under
+// metrics.<quantity> unless rooms.<room>.metrics.<quantity> is set. That
+// is either a list of ranges, which replaces the global ranges, or a map
+// with "ranges" and a "merge" strategy, which defaults to prepend.
+func loadRanges(k *koanf.Koanf, rooms []string) (rangeSet, error) {
+	set := make(rangeSet)
+	for _, room := range rooms {
+		set[room] = make(map[string]roomRanges)
+		for _, q := range quantities {
+			effective, err := loadRoomRanges(k, room, q.key)
+			if err != nil {
+				return nil, err
+			}
+			set[room][q.key] = effective
+		}
+	}
+	return set, nil
+}
+
+// Load the ranges named name under metrics, merged with the overrides of
+// room unless room is empty
+func loadRoomRanges(k *koanf.Koanf, room string, name string) (roomRanges, error) {
+	globalPath := "metrics." + name
+	var global []backend.Range
+	if err := k.Unmarshal(globalPath, &global); err != nil {
+		return roomRanges{}, fmt.Errorf("%s: %w", globalPath, err)
+	}
+
+	path := globalPath
+	override := roomOverride{Merge: MergeInherit}
+	if room != "" {
+		path = "rooms." + room + ".metrics." + name
+		switch k.Get(path).(type) {
+		case nil:
+		case []interface{}:
+			override.Merge = MergeReplace
+			if err := k.Unmarshal(path, &override.Ranges); err != nil {
+				return roomRanges{}, fmt.Errorf("%s: %w", path, err)
+			}
+		default:
+			override.Merge = MergePrepend
+			if err := k.Unmarshal(path, &override); err != nil {
+				return roomRanges{}, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+
+	effective, err := mergeRanges(override, global)
+	if err != nil {
+		return roomRanges{}, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, metricRange := range effective.Ranges {
+		if metricRange.Schedule == nil {
+			continue
+		}
+		if err := metricRange.Schedule.Validate(); err != nil {
+			return roomRanges{}, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return effective, nil
+}
+
+// LoadRanges returns the ranges named name under metrics in the config,
+// such as "temperature". With room set, the overrides of the room are
+// merged in as they are for the rooms the collector reads.
+func LoadRanges(configDir string, name string, room string) ([]backend.Range, error) {
+	k, err := loadConfig(configDir)
+	if err != nil {
+		return nil, fmt.Errorf("error loading config file: %w", err)
+	}
+	if !k.Exists("metrics."+name) && (room == "" || !k.Exists("rooms."+room+".metrics."+name)) {
+		return nil, fmt.Errorf("no ranges named %s", name)
+	}
+	effective, err := loadRoomRanges(k, room, name)
+	if err != nil {
+		return nil, err
+	}
+	return effective.Ranges, nil
+}
+
+func mergeRanges(override roomOverride, global []backend.Range) (roomRanges, error) {
+	sources := func(source string, n int) []string {
+		s := make([]string, n)
+		for i := range s {
+			s[i] = source
+		}
+		return s
+	}
+	room := override.Ranges
+
+	switch override.Merge {
+	case MergeInherit:
+		return roomRanges{
+			Merge:   MergeInherit,
+			Ranges:  global,
+			Sources: sources("global", len(global)),
+		}, nil
+	case MergeReplace:
+		return roomRanges{
+			Merge:   MergeReplace,
+			Ranges:  room,
+			Sources: sources("room", len(room)),
+		}, nil
+	case MergePrepend:
+		return roomRanges{
+			Merge:   MergePrepend,
+			Ranges:  slices.Concat(room, global),
+			Sources: slices.Concat(sources("room", len(room)), sources("global", len(global))),
+		}, nil
+	case MergeAppend:
+		return roomRanges{
+			Merge:   MergeAppend,
+			Ranges:  slices.Concat(global, room),
+			Sources: slices.Concat(sources("global", len(global)), sources("room", len(room))),
+		}, nil
+	}
+	return roomRanges{}, fmt.Errorf("unknown merge strategy: %s", override.Merge)
+}
+
+// Metric published in place of a range metric when a reading falls in no
+// range, so that consumers can tell a normal reading from a missing one
+type okConfig struct {
+	Priority int    `koanf:"priority"`
+	Colour   string `koanf:"colour"`
+}
+
+// Load the ok metric under "ok". Without one, the metrics of readings which
+// fall in no range are deleted instead.
+func loadOK(k *koanf.Koanf) (*okConfig, error) {
+	if !k.Exists("ok") {
+		return nil, nil
+	}
+	okMetric := &okConfig{}
+	if err := k.Unmarshal("ok", okMetric); err != nil {
+		return nil, fmt.Errorf("ok: %w", err)
+	}
+	if okMetric.Colour == "" {
+		return nil, fmt.Errorf("ok: colour is required")
+	}
+	return okMetric, nil
+}
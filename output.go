@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/venkytv/homemon/backend"
+)
+
+// Output formats of metrics list
+var outputFormats = []string{"table", "json", "yaml", "csv", "template"}
+
+// Sort orders of metrics list
+var sortOrders = []string{"priority", "name", "ttl", "updated"}
+
+// Options of metrics list
+type listOptions struct {
+	output   string
+	template *template.Template
+	sortBy   string
+	reverse  bool
+	swatches bool // Draw truecolour swatches in the table
+	styled   bool // Use ANSI styles in the table
+}
+
+// A metric as shown by metrics list
+type metricView struct {
+	Name         string     `json:"name" yaml:"name"`
+	Priority     int        `json:"priority" yaml:"priority"`
+	Colour       string     `json:"colour" yaml:"colour"`
+	TTL          *time.Time `json:"ttl,omitempty" yaml:"ttl,omitempty"` // Overrides have none
+	TTLRemaining string     `json:"ttl_remaining,omitempty" yaml:"ttl_remaining,omitempty"`
+	Value        *float64   `json:"value,omitempty" yaml:"value,omitempty"`
+	Unit         string     `json:"unit,omitempty" yaml:"unit,omitempty"`
+	Message      string     `json:"message,omitempty" yaml:"message,omitempty"`
+	Source       string     `json:"source,omitempty" yaml:"source,omitempty"`
+	UpdatedAt    *time.Time `json:"updated_at,omitempty" yaml:"updated_at,omitempty"`
+	Updated      string     `json:"updated,omitempty" yaml:"updated,omitempty"` // Relative to now
+	Override     bool       `json:"override,omitempty" yaml:"override,omitempty"`
+	Schedule     string     `json:"schedule,omitempty" yaml:"schedule,omitempty"`
+	State        string     `json:"state,omitempty" yaml:"state,omitempty"`
+}
+
+func newMetricView(metric backend.Metric, suppressions []backend.Suppression, now time.Time) metricView {
+	view := metricView{
+		Name:     metric.Name,
+		Priority: metric.Priority,
+		Colour:   metric.Colour,
+		Value:    metric.Value,
+		Unit:     metric.Unit,
+		Message:  metric.Message,
+		Source:   metric.Source,
+		Override: metric.Override,
+	}
+	if metric.Override {
+		view.State = "override"
+		if !metric.OverrideActive(now) {
+			view.State = "override, inactive"
+		}
+		if metric.Schedule != nil {
+			view.Schedule = metric.Schedule.String()
+		}
+	} else {
+		ttl := metric.TTL
+		view.TTL = &ttl
+		view.TTLRemaining = relativeDuration(ttl.Sub(now))
+		if s, ok := backend.FindSuppression(suppressions, metric, now); ok {
+			view.State = suppressionState(s, now)
+		}
+	}
+	if !metric.UpdatedAt.IsZero() {
+		updated := metric.UpdatedAt
+		view.UpdatedAt = &updated
+		view.Updated = "just now"
+		if age := now.Sub(updated); age >= time.Second {
+			view.Updated = relativeDuration(age) + " ago"
+		}
+	}
+	return view
+}
+
+// Format a duration rounded to seconds, or "expired" if it has passed
+func relativeDuration(d time.Duration) string {
+	if d <= 0 {
+		return "expired"
+	}
+	return d.Round(time.Second).String()
+}
+
+// Sort metric views, keeping overrides first when sorting by priority
+func sortViews(views []metricView, sortBy string, reverse bool) {
+	less := func(a, b metricView) bool {
+		switch sortBy {
+		case "name":
+			return a.Name < b.Name
+		case "ttl":
+			// Soonest to expire first, overrides last
+			if a.TTL == nil || b.TTL == nil {
+				return a.TTL != nil && b.TTL == nil
+			}
+			return a.TTL.Before(*b.TTL)
+		case "updated":
+			// Most recently updated first
+			if a.UpdatedAt == nil || b.UpdatedAt == nil {
+				return a.UpdatedAt != nil && b.UpdatedAt == nil
+			}
+			return a.UpdatedAt.After(*b.UpdatedAt)
+		}
+		if a.Override != b.Override {
+			return a.Override
+		}
+		return a.Priority > b.Priority
+	}
+	sort.SliceStable(views, func(i, j int) bool {
+		if reverse {
+			return less(views[j], views[i])
+		}
+		return less(views[i], views[j])
+	})
+}
+
+// Write metrics in the format given by opts
+func writeMetrics(w io.Writer, metrics []backend.Metric, suppressions []backend.Suppression, now time.Time, opts listOptions) error {
+	views := make([]metricView, 0, len(metrics))
+	for _, metric := range metrics {
+		views = append(views, newMetricView(metric, suppressions, now))
+	}
+	sortViews(views, opts.sortBy, opts.reverse)
+
+	switch opts.output {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(views)
+	case "yaml":
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		return enc.Encode(views)
+	case "csv":
+		return writeCSV(w, views)
+	case "template":
+		for _, view := range views {
+			if err := opts.template.Execute(w, view); err != nil {
+				return err
+			}
+			fmt.Fprintln(w)
+		}
+		return nil
+	}
+	writeTable(w, views, opts, nil)
+	writeSuppressions(w, suppressions, now)
+	return nil
+}
+
+// Write the active suppressions after a table
+func writeSuppressions(w io.Writer, suppressions []backend.Suppression, now time.Time) {
+	if len(suppressions) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "\nSuppressions:")
+	for _, s := range suppressions {
+		fmt.Fprintf(w, "  %s: %s\n", s.Pattern, suppressionState(s, now))
+	}
+}
+
+func writeCSV(w io.Writer, views []metricView) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"name", "priority", "colour", "ttl", "ttl_remaining", "value", "unit", "message", "source", "updated_at", "override", "schedule", "state"})
+	for _, view := range views {
+		var ttl, value, updated string
+		if view.TTL != nil {
+			ttl = view.TTL.Format(time.RFC3339)
+		}
+		if view.Value != nil {
+			value = strconv.FormatFloat(*view.Value, 'f', -1, 64)
+		}
+		if view.UpdatedAt != nil {
+			updated = view.UpdatedAt.Format(time.RFC3339)
+		}
+		out.Write([]string{
+			view.Name,
+			strconv.Itoa(view.Priority),
+			view.Colour,
+			ttl,
+			view.TTLRemaining,
+			value,
+			view.Unit,
+			view.Message,
+			view.Source,
+			updated,
+			strconv.FormatBool(view.Override),
+			view.Schedule,
+			view.State,
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// A table cell with an optional swatch drawn before the text and an
+// optional escape sequence styling the text
+type cell struct {
+	text   string
+	swatch string
+	style  string
+}
+
+// Width of the swatch and the space after it
+const swatchWidth = 3
+
+// Styles of the change markers shown in watch mode and of the selection in
+// the dashboard
+var markStyles = map[string]string{
+	markAdded:    "\x1b[1;32m",
+	markChanged:  "\x1b[1;33m",
+	markRemoved:  "\x1b[31;9m",
+	markSelected: "\x1b[1;7m",
+}
+
+// Write views as a table. With marks, a first column shows the change
+// marker of each metric by name.
+func writeTable(w io.Writer, views []metricView, opts listOptions, marks map[string]string) {
+	header := []cell{{text: "NAME"}, {text: "PRIORITY"}, {text: "COLOUR"}, {text: "TTL"}, {text: "VALUE"}, {text: "UPDATED"}, {text: "SOURCE"}, {text: "STATE"}, {text: "MESSAGE"}}
+	if marks != nil {
+		header = append([]cell{{text: " "}}, header...)
+	}
+	rows := [][]cell{header}
+	for _, view := range views {
+		value := ""
+		if view.Value != nil {
+			value = strconv.FormatFloat(*view.Value, 'g', 6, 64)
+			if view.Unit != "" {
+				value += " " + view.Unit
+			}
+		}
+		name := cell{text: view.Name}
+		colour := cell{text: view.Colour}
+		if opts.swatches {
+			colour.swatch = swatch(view.Colour)
+		}
+		row := []cell{
+			name,
+			{text: strconv.Itoa(view.Priority)},
+			colour,
+			{text: orDash(view.TTLRemaining)},
+			{text: orDash(value)},
+			{text: orDash(view.Updated)},
+			{text: orDash(view.Source)},
+			{text: orDash(view.State)},
+			{text: view.Message},
+		}
+		if marks != nil {
+			mark := cell{text: marks[view.Name]}
+			if opts.styled {
+				mark.style = markStyles[mark.text]
+				row[0].style = mark.style
+			}
+			row = append([]cell{mark}, row...)
+		}
+		rows = append(rows, row)
+	}
+	writeCells(w, rows)
+}
+
+// Write rows of cells as aligned columns. tabwriter can't be used as the
+// swatches and styles contain escape sequences, which would be counted in
+// the column widths.
+func writeCells(w io.Writer, rows [][]cell) {
+	cellWidth := func(c cell) int {
+		width := utf8.RuneCountInString(c.text)
+		if c.swatch != "" {
+			width += swatchWidth
+		}
+		return width
+	}
+
+	var widths []int
+	for _, row := range rows {
+		for i, c := range row {
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[i] = max(widths[i], cellWidth(c))
+		}
+	}
+	for _, row := range rows {
+		var line strings.Builder
+		for i, c := range row {
+			line.WriteString(c.swatch)
+			if c.style != "" {
+				line.WriteString(c.style + c.text + "\x1b[0m")
+			} else {
+				line.WriteString(c.text)
+			}
+			if i < len(row)-1 {
+				line.WriteString(strings.Repeat(" ", widths[i]-cellWidth(c)+2))
+			}
+		}
+		fmt.Fprintln(w, strings.TrimRight(line.String(), " "))
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// A block in the given colour using a truecolour escape sequence, or blank
+// space of the same width for colours without RGB values
+func swatch(colour string) string {
+	r, g, b, ok := backend.RGB(colour)
+	if !ok {
+		return strings.Repeat(" ", swatchWidth)
+	}
+	return fmt.Sprintf("\x1b[38;2;%d;%d;%dm██\x1b[0m ", r, g, b)
+}
+
+// Whether f is a terminal and NO_COLOR is not set
+func styled(f *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Whether f is a terminal which supports truecolour. Set NO_COLOR to turn
+// swatches off.
+func truecolour(f *os.File) bool {
+	colorterm := os.Getenv("COLORTERM")
+	return styled(f) && (colorterm == "truecolor" || colorterm == "24bit")
+}
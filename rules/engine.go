@@ -0,0 +1,134 @@
+package rules
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Rule is a rule as written in the config file
+type Rule struct {
+	Name     string `koanf:"name"`
+	When     string `koanf:"when"`
+	Priority int    `koanf:"priority"`
+	Colour   string `koanf:"colour"`
+	Message  string `koanf:"message"` // Template for the metric message, optional
+}
+
+// Result is the outcome of evaluating a rule. Per-room rules produce one
+// result per room, named "<rule>:<room>".
+type Result struct {
+	Name     string
+	Rule     string
+	Room     string // Empty for rules not evaluated per room
+	When     string
+	Message  string
+	Priority int
+	Colour   string
+	Active   bool
+}
+
+type compiledRule struct {
+	Rule
+	expr *Expression
+}
+
+// Engine evaluates rules against a window of recent readings
+type Engine struct {
+	rules  []compiledRule
+	rooms  []string
+	window *Window
+	// When each result's condition started holding, for "for" clauses
+	since map[string]time.Time
+}
+
+// NewEngine compiles the rules for the given rooms and quantities
+func NewEngine(rules []Rule, rooms []string, quantities []string) (*Engine, error) {
+	e := &Engine{
+		rooms: slices.Clone(rooms),
+		since: make(map[string]time.Time),
+	}
+	sort.Strings(e.rooms)
+
+	span := time.Duration(0)
+	for _, rule := range rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rule %q has no name", rule.When)
+		}
+		if slices.Contains(quantities, rule.Name) {
+			return nil, fmt.Errorf("rule %s: name clashes with a quantity", rule.Name)
+		}
+		expr, err := Parse(rule.When, quantities)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", rule.Name, err)
+		}
+		for _, room := range expr.Rooms() {
+			if !slices.Contains(e.rooms, room) {
+				return nil, fmt.Errorf("rule %s: unknown room or quantity %q", rule.Name, room)
+			}
+		}
+		span = max(span, expr.Span(), expr.For)
+		e.rules = append(e.rules, compiledRule{Rule: rule, expr: expr})
+	}
+
+	// Keep a little more than the longest span so trends can see a reading
+	// from the start of their span
+	e.window = NewWindow(span + 10*time.Minute)
+	return e, nil
+}
+
+// SetTTL sets how long the readings of a room count once the room stops
+// reporting. It defaults to the longest span of the rules.
+func (e *Engine) SetTTL(room string, ttl time.Duration) {
+	e.window.SetMaxAge(room, ttl)
+}
+
+// Observe records a reading
+func (e *Engine) Observe(room, quantity string, t time.Time, value float64) {
+	e.window.Add(room, quantity, t, value)
+}
+
+// Evaluate evaluates every rule at now
+func (e *Engine) Evaluate(now time.Time) []Result {
+	var results []Result
+	for _, rule := range e.rules {
+		rooms := []string{""}
+		if rule.expr.PerRoom() {
+			rooms = e.rooms
+		}
+		for _, room := range rooms {
+			name := rule.Name
+			if room != "" {
+				name += ":" + room
+			}
+			ctx := &evalContext{window: e.window, room: room, now: now}
+			results = append(results, Result{
+				Name:     name,
+				Rule:     rule.Name,
+				Room:     room,
+				When:     rule.When,
+				Message:  rule.Message,
+				Priority: rule.Priority,
+				Colour:   rule.Colour,
+				Active:   e.held(name, rule.expr.cond.eval(ctx), rule.expr.For, now),
+			})
+		}
+	}
+	return results
+}
+
+// Track how long a condition has held and check it against the "for"
+// duration
+func (e *Engine) held(name string, holds bool, duration time.Duration, now time.Time) bool {
+	if !holds {
+		delete(e.since, name)
+		return false
+	}
+	since, ok := e.since[name]
+	if !ok {
+		since = now
+		e.since[name] = now
+	}
+	return now.Sub(since) >= duration
+}
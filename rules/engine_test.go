@@ -0,0 +1,247 @@
+package rules
+
+import (
+	"testing"
+	"time"
+)
+
+type testReading struct {
+	at       time.Duration
+	room     string
+	quantity string
+	value    float64
+}
+
+func TestEngine(t *testing.T) {
+	tests := []struct {
+		name     string
+		when     string
+		ttl      map[string]time.Duration
+		readings []testReading
+		at       time.Duration
+		want     map[string]bool
+	}{
+		{
+			name: "comparison",
+			when: "co2 > 1200",
+			readings: []testReading{
+				{0, "bedroom", "co2", 1300},
+				{0, "livingroom", "co2", 900},
+			},
+			want: map[string]bool{"r:bedroom": true, "r:livingroom": false},
+		},
+		{
+			name: "comparison without a reading",
+			when: "co2 > 1200",
+			readings: []testReading{
+				{0, "bedroom", "humidity", 60},
+			},
+			want: map[string]bool{"r:bedroom": false},
+		},
+		{
+			name: "for held",
+			when: "co2 > 1200 for 15m",
+			readings: []testReading{
+				{0, "bedroom", "co2", 1300},
+				{5 * time.Minute, "bedroom", "co2", 1250},
+				{10 * time.Minute, "bedroom", "co2", 1400},
+				{15 * time.Minute, "bedroom", "co2", 1300},
+			},
+			at:   15 * time.Minute,
+			want: map[string]bool{"r:bedroom": true},
+		},
+		{
+			name: "for not held long enough",
+			when: "co2 > 1200 for 15m",
+			readings: []testReading{
+				{0, "bedroom", "co2", 1300},
+				{10 * time.Minute, "bedroom", "co2", 1300},
+			},
+			at:   10 * time.Minute,
+			want: map[string]bool{"r:bedroom": false},
+		},
+		{
+			name: "for interrupted",
+			when: "co2 > 1200 for 15m",
+			readings: []testReading{
+				{0, "bedroom", "co2", 1300},
+				{5 * time.Minute, "bedroom", "co2", 900},
+				{10 * time.Minute, "bedroom", "co2", 1300},
+				{15 * time.Minute, "bedroom", "co2", 1300},
+			},
+			at:   15 * time.Minute,
+			want: map[string]bool{"r:bedroom": false},
+		},
+		{
+			name: "rising",
+			when: "humidity rising by 10 in 30m",
+			readings: []testReading{
+				{0, "bedroom", "humidity", 50},
+				{20 * time.Minute, "bedroom", "humidity", 62},
+			},
+			at:   20 * time.Minute,
+			want: map[string]bool{"r:bedroom": true},
+		},
+		{
+			name: "rising too little",
+			when: "humidity rising by 10 in 30m",
+			readings: []testReading{
+				{0, "bedroom", "humidity", 50},
+				{20 * time.Minute, "bedroom", "humidity", 55},
+			},
+			at:   20 * time.Minute,
+			want: map[string]bool{"r:bedroom": false},
+		},
+		{
+			name: "rising outside the span",
+			when: "humidity rising by 10 in 30m",
+			readings: []testReading{
+				{0, "bedroom", "humidity", 40},
+				{20 * time.Minute, "bedroom", "humidity", 48},
+				{40 * time.Minute, "bedroom", "humidity", 52},
+			},
+			at:   40 * time.Minute,
+			want: map[string]bool{"r:bedroom": false},
+		},
+		{
+			name: "falling",
+			when: "temperature falling by 2 in 1h",
+			readings: []testReading{
+				{0, "bedroom", "temperature", 22},
+				{30 * time.Minute, "bedroom", "temperature", 21},
+				{50 * time.Minute, "bedroom", "temperature", 19.5},
+			},
+			at:   50 * time.Minute,
+			want: map[string]bool{"r:bedroom": true, "r:livingroom": false},
+		},
+		{
+			name: "in room",
+			when: "co2 in bedroom > 1000",
+			readings: []testReading{
+				{0, "bedroom", "co2", 1100},
+				{0, "livingroom", "co2", 600},
+			},
+			want: map[string]bool{"r": true},
+		},
+		{
+			name: "difference between rooms",
+			when: "temperature in bedroom < livingroom - 3",
+			readings: []testReading{
+				{0, "bedroom", "temperature", 18},
+				{0, "livingroom", "temperature", 22},
+			},
+			want: map[string]bool{"r": true},
+		},
+		{
+			name: "difference between rooms too small",
+			when: "temperature in bedroom < livingroom - 3",
+			readings: []testReading{
+				{0, "bedroom", "temperature", 20},
+				{0, "livingroom", "temperature", 22},
+			},
+			want: map[string]bool{"r": false},
+		},
+		{
+			name: "difference with a room missing",
+			when: "temperature in bedroom - temperature in livingroom > 3",
+			readings: []testReading{
+				{0, "bedroom", "temperature", 26},
+			},
+			want: map[string]bool{"r": false},
+		},
+		{
+			name: "sum of rooms",
+			when: "co2 in bedroom + co2 in livingroom > 2000",
+			readings: []testReading{
+				{0, "bedroom", "co2", 1100},
+				{0, "livingroom", "co2", 1000},
+			},
+			want: map[string]bool{"r": true},
+		},
+		{
+			name: "stale reading",
+			when: "co2 > 1200",
+			ttl:  map[string]time.Duration{"bedroom": 10 * time.Minute},
+			readings: []testReading{
+				{0, "bedroom", "co2", 1300},
+			},
+			at:   15 * time.Minute,
+			want: map[string]bool{"r:bedroom": false},
+		},
+		{
+			name: "reading within the TTL",
+			when: "co2 > 1200",
+			ttl:  map[string]time.Duration{"bedroom": 10 * time.Minute},
+			readings: []testReading{
+				{0, "bedroom", "co2", 1300},
+			},
+			at:   5 * time.Minute,
+			want: map[string]bool{"r:bedroom": true},
+		},
+		{
+			name: "stale trend",
+			when: "humidity rising by 10 in 30m",
+			ttl:  map[string]time.Duration{"bedroom": 5 * time.Minute},
+			readings: []testReading{
+				{0, "bedroom", "humidity", 50},
+				{10 * time.Minute, "bedroom", "humidity", 62},
+			},
+			at:   20 * time.Minute,
+			want: map[string]bool{"r:bedroom": false},
+		},
+	}
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := Rule{Name: "r", When: tt.when, Priority: 5, Colour: "red"}
+			engine, err := NewEngine([]Rule{rule}, []string{"livingroom", "bedroom"}, testQuantities)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for room, ttl := range tt.ttl {
+				engine.SetTTL(room, ttl)
+			}
+			// Evaluate after every reading, as the collector does after
+			// every poll, so "for" clauses see the condition over time
+			for _, reading := range tt.readings {
+				at := start.Add(reading.at)
+				engine.Observe(reading.room, reading.quantity, at, reading.value)
+				engine.Evaluate(at)
+			}
+
+			active := make(map[string]bool)
+			for _, result := range engine.Evaluate(start.Add(tt.at)) {
+				active[result.Name] = result.Active
+			}
+			for name, want := range tt.want {
+				got, ok := active[name]
+				if !ok {
+					t.Errorf("no result for %s", name)
+					continue
+				}
+				if got != want {
+					t.Errorf("%s active = %t, want %t", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestEngineErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+	}{
+		{"no name", Rule{When: "co2 > 1200"}},
+		{"name clashes with a quantity", Rule{Name: "co2", When: "co2 > 1200"}},
+		{"unknown room", Rule{Name: "r", When: "co2 in attic > 1200"}},
+		{"invalid expression", Rule{Name: "r", When: "co2 >"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewEngine([]Rule{tt.rule}, []string{"bedroom"}, testQuantities); err == nil {
+				t.Error("rule was accepted")
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package rules
+
+import (
+	"time"
+)
+
+// Evaluation context for one room, or for no room in particular
+type evalContext struct {
+	window *Window
+	room   string
+	now    time.Time
+}
+
+type boolNode interface {
+	eval(ctx *evalContext) bool
+}
+
+type valueNode interface {
+	// Value of the node, or false if a reading is missing
+	value(ctx *evalContext) (float64, bool)
+}
+
+type numberNode struct {
+	number float64
+}
+
+type refNode struct {
+	quantity string
+	room     string // Empty for the room the rule is evaluated for
+}
+
+type arithNode struct {
+	op          string
+	left, right valueNode
+}
+
+type compareNode struct {
+	op          string
+	left, right valueNode
+}
+
+type trendNode struct {
+	ref    *refNode
+	rising bool
+	by     float64
+	span   time.Duration
+}
+
+type logicNode struct {
+	and         bool
+	left, right boolNode
+}
+
+type notNode struct {
+	cond boolNode
+}
+
+func (n *numberNode) value(_ *evalContext) (float64, bool) {
+	return n.number, true
+}
+
+func (n *refNode) resolveRoom(ctx *evalContext) string {
+	if n.room != "" {
+		return n.room
+	}
+	return ctx.room
+}
+
+func (n *refNode) value(ctx *evalContext) (float64, bool) {
+	return ctx.window.Latest(n.resolveRoom(ctx), n.quantity, ctx.now)
+}
+
+func (n *arithNode) value(ctx *evalContext) (float64, bool) {
+	left, ok := n.left.value(ctx)
+	if !ok {
+		return 0, false
+	}
+	right, ok := n.right.value(ctx)
+	if !ok {
+		return 0, false
+	}
+	if n.op == "+" {
+		return left + right, true
+	}
+	return left - right, true
+}
+
+func (n *compareNode) eval(ctx *evalContext) bool {
+	left, ok := n.left.value(ctx)
+	if !ok {
+		return false
+	}
+	right, ok := n.right.value(ctx)
+	if !ok {
+		return false
+	}
+	switch n.op {
+	case "<":
+		return left < right
+	case "<=":
+		return left <= right
+	case ">":
+		return left > right
+	case ">=":
+		return left >= right
+	case "==":
+		return left == right
+	case "!=":
+		return left != right
+	}
+	return false
+}
+
+// A quantity is rising by n if the latest reading is at least n above the
+// lowest reading in the span, and falling if it is n below the highest
+func (n *trendNode) eval(ctx *evalContext) bool {
+	samples := ctx.window.Since(n.ref.resolveRoom(ctx), n.ref.quantity, ctx.now.Add(-n.span), ctx.now)
+	if len(samples) < 2 {
+		return false
+	}
+	latest := samples[len(samples)-1].Value
+	for _, sample := range samples[:len(samples)-1] {
+		if n.rising && latest-sample.Value >= n.by {
+			return true
+		}
+		if !n.rising && sample.Value-latest >= n.by {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *logicNode) eval(ctx *evalContext) bool {
+	if n.and {
+		return n.left.eval(ctx) && n.right.eval(ctx)
+	}
+	return n.left.eval(ctx) || n.right.eval(ctx)
+}
+
+func (n *notNode) eval(ctx *evalContext) bool {
+	return !n.cond.eval(ctx)
+}
+
+// Walk every quantity/room reference in a value
+func walkRefs(v valueNode, fn func(*refNode)) {
+	switch n := v.(type) {
+	case *refNode:
+		fn(n)
+	case *arithNode:
+		walkRefs(n.left, fn)
+		walkRefs(n.right, fn)
+	}
+}
+
+// Walk every reference in a condition
+func walkCondRefs(b boolNode, fn func(*refNode)) {
+	switch n := b.(type) {
+	case *compareNode:
+		walkRefs(n.left, fn)
+		walkRefs(n.right, fn)
+	case *trendNode:
+		fn(n.ref)
+	case *logicNode:
+		walkCondRefs(n.left, fn)
+		walkCondRefs(n.right, fn)
+	case *notNode:
+		walkCondRefs(n.cond, fn)
+	}
+}
+
+func firstQuantity(v valueNode) string {
+	quantity := ""
+	walkRefs(v, func(ref *refNode) {
+		if quantity == "" {
+			quantity = ref.quantity
+		}
+	})
+	return quantity
+}
+
+func hasRefs(v valueNode) bool {
+	found := false
+	walkRefs(v, func(*refNode) { found = true })
+	return found
+}
+
+func fillQuantity(v valueNode, quantity string) {
+	walkRefs(v, func(ref *refNode) {
+		if ref.quantity == "" {
+			ref.quantity = quantity
+		}
+	})
+}
+
+// PerRoom reports whether the expression refers to the current room, in
+// which case it is evaluated separately for every room
+func (e *Expression) PerRoom() bool {
+	perRoom := false
+	walkCondRefs(e.cond, func(ref *refNode) {
+		if ref.room == "" {
+			perRoom = true
+		}
+	})
+	return perRoom
+}
+
+// Rooms returns the rooms named explicitly in the expression
+func (e *Expression) Rooms() []string {
+	var rooms []string
+	walkCondRefs(e.cond, func(ref *refNode) {
+		if ref.room != "" {
+			rooms = append(rooms, ref.room)
+		}
+	})
+	return rooms
+}
+
+// Span returns the longest trend span in the expression
+func (e *Expression) Span() time.Duration {
+	var span time.Duration
+	var walk func(boolNode)
+	walk = func(b boolNode) {
+		switch n := b.(type) {
+		case *trendNode:
+			span = max(span, n.span)
+		case *logicNode:
+			walk(n.left)
+			walk(n.right)
+		case *notNode:
+			walk(n.cond)
+		}
+	}
+	walk(e.cond)
+	return span
+}
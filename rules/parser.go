@@ -0,0 +1,365 @@
+package rules
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Expressions look like:
+//
+//	co2 > 1200 for 15m
+//	humidity rising by 10 in 30m
+//	temperature in bedroom < livingroom - 3
+//	co2 > 1000 and (noise > 60 or temperature >= 26)
+//
+// Quantities without "in <room>" refer to the room the rule is evaluated
+// for. A bare room name takes the quantity from the other side of the
+// comparison. A trailing "for <duration>" requires the whole condition to
+// hold for that long.
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber // numbers and durations, e.g. 12.5 or 15m
+	tokOp
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func tokenize(input string) ([]token, error) {
+	var tokens []token
+	runes := []rune(input)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{tokLParen, "(", i})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{tokRParen, ")", i})
+			i++
+		case strings.ContainsRune("<>=!", r):
+			start := i
+			i++
+			if i < len(runes) && runes[i] == '=' {
+				i++
+			}
+			op := string(runes[start:i])
+			if op == "=" || op == "!" {
+				return nil, fmt.Errorf("unexpected %q at %d", op, start)
+			}
+			tokens = append(tokens, token{tokOp, op, start})
+		case r == '+' || r == '-':
+			tokens = append(tokens, token{tokOp, string(r), i})
+			i++
+		case unicode.IsDigit(r) || r == '.':
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.' || unicode.IsLetter(runes[i])) {
+				i++
+			}
+			tokens = append(tokens, token{tokNumber, string(runes[start:i]), start})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) {
+				c := runes[i]
+				// Allow dashes inside names like "living-room", but not
+				// before a number so "livingroom-3" is a subtraction
+				if c == '-' && i+1 < len(runes) && unicode.IsLetter(runes[i+1]) {
+					i++
+					continue
+				}
+				if !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '_' {
+					break
+				}
+				i++
+			}
+			tokens = append(tokens, token{tokIdent, string(runes[start:i]), start})
+		default:
+			return nil, fmt.Errorf("unexpected %q at %d", r, i)
+		}
+	}
+	return append(tokens, token{tokEOF, "", len(runes)}), nil
+}
+
+type parser struct {
+	tokens     []token
+	pos        int
+	quantities map[string]bool
+}
+
+// Expression is a parsed rule condition
+type Expression struct {
+	cond boolNode
+	// How long cond must hold before the expression is true
+	For time.Duration
+}
+
+// Parse parses a rule expression. Identifiers in quantities are treated as
+// quantities and any other identifier as a room name.
+func Parse(input string, quantities []string) (*Expression, error) {
+	tokens, err := tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{
+		tokens:     tokens,
+		quantities: make(map[string]bool),
+	}
+	for _, q := range quantities {
+		p.quantities[q] = true
+	}
+
+	cond, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	expr := &Expression{cond: cond}
+	if p.acceptKeyword("for") {
+		if expr.For, err = p.parseDuration(); err != nil {
+			return nil, err
+		}
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at %d", tok.text, tok.pos)
+	}
+	return expr, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) isKeyword(word string) bool {
+	tok := p.peek()
+	return tok.kind == tokIdent && strings.EqualFold(tok.text, word)
+}
+
+func (p *parser) acceptKeyword(word string) bool {
+	if p.isKeyword(word) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectKeyword(word string) error {
+	if !p.acceptKeyword(word) {
+		tok := p.peek()
+		return fmt.Errorf("expected %q at %d, got %q", word, tok.pos, tok.text)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (boolNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicNode{and: false, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (boolNode, error) {
+	left, err := p.parseCondition()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptKeyword("and") {
+		right, err := p.parseCondition()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicNode{and: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseCondition() (boolNode, error) {
+	if p.acceptKeyword("not") {
+		cond, err := p.parseCondition()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{cond: cond}, nil
+	}
+
+	// A parenthesis may open either a nested condition or an arithmetic
+	// operand, so try the condition first and backtrack
+	if p.peek().kind == tokLParen {
+		start := p.pos
+		p.next()
+		if cond, err := p.parseOr(); err == nil && p.peek().kind == tokRParen {
+			p.next()
+			return cond, nil
+		}
+		p.pos = start
+	}
+
+	left, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+
+	// Trend: <quantity> [in <room>] rising|falling by <number> in <duration>
+	if p.isKeyword("rising") || p.isKeyword("falling") {
+		ref, ok := left.(*refNode)
+		if !ok || ref.quantity == "" {
+			return nil, fmt.Errorf("%s needs a quantity at %d", p.peek().text, p.peek().pos)
+		}
+		rising := strings.EqualFold(p.next().text, "rising")
+		if err := p.expectKeyword("by"); err != nil {
+			return nil, err
+		}
+		by, err := p.parseNumber()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("in"); err != nil {
+			return nil, err
+		}
+		span, err := p.parseDuration()
+		if err != nil {
+			return nil, err
+		}
+		return &trendNode{ref: ref, rising: rising, by: by, span: span}, nil
+	}
+
+	tok := p.next()
+	if tok.kind != tokOp || tok.text == "+" || tok.text == "-" {
+		return nil, fmt.Errorf("expected comparison at %d, got %q", tok.pos, tok.text)
+	}
+	right, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+
+	// Bare room names take the quantity from the other side
+	quantity := firstQuantity(left)
+	if quantity == "" {
+		quantity = firstQuantity(right)
+	}
+	if quantity == "" && (hasRefs(left) || hasRefs(right)) {
+		return nil, fmt.Errorf("comparison at %d does not name a quantity", tok.pos)
+	}
+	fillQuantity(left, quantity)
+	fillQuantity(right, quantity)
+
+	return &compareNode{op: tok.text, left: left, right: right}, nil
+}
+
+func (p *parser) parseValue() (valueNode, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok := p.peek()
+		if tok.kind != tokOp || (tok.text != "+" && tok.text != "-") {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = &arithNode{op: tok.text, left: left, right: right}
+	}
+}
+
+func (p *parser) parseTerm() (valueNode, error) {
+	tok := p.peek()
+	switch tok.kind {
+	case tokNumber:
+		v, err := p.parseNumber()
+		if err != nil {
+			return nil, err
+		}
+		return &numberNode{number: v}, nil
+	case tokOp:
+		if tok.text == "-" {
+			p.next()
+			term, err := p.parseTerm()
+			if err != nil {
+				return nil, err
+			}
+			return &arithNode{op: "-", left: &numberNode{}, right: term}, nil
+		}
+	case tokLParen:
+		p.next()
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		if p.next().kind != tokRParen {
+			return nil, fmt.Errorf("expected ) at %d", tok.pos)
+		}
+		return value, nil
+	case tokIdent:
+		p.next()
+		name := strings.ToLower(tok.text)
+		if !p.quantities[name] {
+			return &refNode{room: tok.text}, nil
+		}
+		ref := &refNode{quantity: name}
+		if p.acceptKeyword("in") {
+			room := p.next()
+			if room.kind != tokIdent {
+				return nil, fmt.Errorf("expected room name at %d", room.pos)
+			}
+			ref.room = room.text
+		}
+		return ref, nil
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", tok.text, tok.pos)
+}
+
+func (p *parser) parseNumber() (float64, error) {
+	tok := p.next()
+	if tok.kind != tokNumber {
+		return 0, fmt.Errorf("expected number at %d, got %q", tok.pos, tok.text)
+	}
+	v, err := strconv.ParseFloat(tok.text, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q at %d", tok.text, tok.pos)
+	}
+	return v, nil
+}
+
+func (p *parser) parseDuration() (time.Duration, error) {
+	tok := p.next()
+	if tok.kind != tokNumber {
+		return 0, fmt.Errorf("expected duration at %d, got %q", tok.pos, tok.text)
+	}
+	d, err := time.ParseDuration(tok.text)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q at %d", tok.text, tok.pos)
+	}
+	return d, nil
+}
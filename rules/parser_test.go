@@ -0,0 +1,79 @@
+package rules
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+var testQuantities = []string{"co2", "humidity", "temperature", "noise"}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input    string
+		perRoom  bool
+		rooms    []string
+		span     time.Duration
+		duration time.Duration
+	}{
+		{input: "co2 > 1200", perRoom: true},
+		{input: "co2 >= 1200.5", perRoom: true},
+		{input: "temperature != 20", perRoom: true},
+		{input: "co2 > 1200 for 15m", perRoom: true, duration: 15 * time.Minute},
+		{input: "humidity rising by 10 in 30m", perRoom: true, span: 30 * time.Minute},
+		{input: "temperature falling by 2 in 1h", perRoom: true, span: time.Hour},
+		{input: "co2 in bedroom > 1000", rooms: []string{"bedroom"}},
+		{input: "temperature in bedroom < livingroom - 3", rooms: []string{"bedroom", "livingroom"}},
+		{input: "temperature in bedroom - temperature in living-room > 3", rooms: []string{"bedroom", "living-room"}},
+		{input: "humidity in bathroom rising by 10 in 10m", rooms: []string{"bathroom"}, span: 10 * time.Minute},
+		{input: "co2 > 1000 and (noise > 60 or temperature >= 26)", perRoom: true},
+		{input: "not co2 < 800 for 5m", perRoom: true, duration: 5 * time.Minute},
+		{input: "(co2 + 100) > 1200", perRoom: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			expr, err := Parse(tt.input, testQuantities)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expr.PerRoom() != tt.perRoom {
+				t.Errorf("per room = %t, want %t", expr.PerRoom(), tt.perRoom)
+			}
+			if rooms := expr.Rooms(); !slices.Equal(rooms, tt.rooms) {
+				t.Errorf("rooms = %v, want %v", rooms, tt.rooms)
+			}
+			if expr.Span() != tt.span {
+				t.Errorf("span = %s, want %s", expr.Span(), tt.span)
+			}
+			if expr.For != tt.duration {
+				t.Errorf("for = %s, want %s", expr.For, tt.duration)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"co2",
+		"co2 = 1200",
+		"co2 > ",
+		"co2 > 1200 for",
+		"co2 > 1200 for soon",
+		"bedroom > livingroom",
+		"1200 rising by 10 in 30m",
+		"humidity rising 10 in 30m",
+		"humidity rising by 10 in",
+		"co2 in > 1200",
+		"co2 > 1200 and",
+		"(co2 > 1200",
+		"co2 > 1200 $",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			if _, err := Parse(input, testQuantities); err == nil {
+				t.Errorf("%q was accepted", input)
+			}
+		})
+	}
+}
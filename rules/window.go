@@ -0,0 +1,88 @@
+package rules
+
+import (
+	"time"
+)
+
+// Sample is a single reading
+type Sample struct {
+	Time  time.Time
+	Value float64
+}
+
+type seriesKey struct {
+	room     string
+	quantity string
+}
+
+// Window keeps recent readings for each room and quantity
+type Window struct {
+	span   time.Duration
+	maxAge map[string]time.Duration // By room, defaults to the span
+	series map[seriesKey][]Sample
+}
+
+// NewWindow creates a new Window which keeps readings for span
+func NewWindow(span time.Duration) *Window {
+	return &Window{
+		span:   span,
+		maxAge: make(map[string]time.Duration),
+		series: make(map[seriesKey][]Sample),
+	}
+}
+
+// SetMaxAge sets how long the latest reading of a room stays current. A
+// room whose latest reading is older has no readings until the next one.
+func (w *Window) SetMaxAge(room string, maxAge time.Duration) {
+	w.maxAge[room] = maxAge
+}
+
+// Add records a reading and drops readings older than the window span
+func (w *Window) Add(room, quantity string, t time.Time, value float64) {
+	key := seriesKey{room, quantity}
+	samples := append(w.series[key], Sample{Time: t, Value: value})
+
+	cutoff := t.Add(-w.span)
+	first := 0
+	for first < len(samples)-1 && samples[first].Time.Before(cutoff) {
+		first++
+	}
+	w.series[key] = samples[first:]
+}
+
+// Latest returns the most recent reading, unless it is stale at now
+func (w *Window) Latest(room, quantity string, now time.Time) (float64, bool) {
+	samples := w.current(room, quantity, now)
+	if len(samples) == 0 {
+		return 0, false
+	}
+	return samples[len(samples)-1].Value, true
+}
+
+// Since returns the readings taken at or after t, or none if the latest
+// reading is stale at now
+func (w *Window) Since(room, quantity string, t, now time.Time) []Sample {
+	samples := w.current(room, quantity, now)
+	for i, sample := range samples {
+		if !sample.Time.Before(t) {
+			return samples[i:]
+		}
+	}
+	return nil
+}
+
+// Readings of a room and quantity, or none if the latest is too old
+func (w *Window) current(room, quantity string, now time.Time) []Sample {
+	samples := w.series[seriesKey{room, quantity}]
+	if len(samples) == 0 {
+		return nil
+	}
+	maxAge, ok := w.maxAge[room]
+	if !ok {
+		maxAge = w.span
+	}
+	if now.Sub(samples[len(samples)-1].Time) > maxAge {
+		return nil
+	}
+	return samples
+}
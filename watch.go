@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/venkytv/homemon/backend"
+)
+
+// Change markers shown in watch mode
+const (
+	markAdded   = "+"
+	markChanged = "~"
+	markRemoved = "-"
+)
+
+// Metrics as of the latest refresh of the watch view, and how they changed
+// since the refresh before it
+type watchSnapshot struct {
+	fetched      time.Time
+	metrics      []backend.Metric
+	suppressions []backend.Suppression
+	removed      []backend.Metric
+	marks        map[string]string
+	err          error
+}
+
+// Fetch the metrics and mark the ones which appeared, changed priority or
+// colour, or disappeared since previous
+func fetchSnapshot(ctx context.Context, store backend.MetricStore, previous *watchSnapshot) *watchSnapshot {
+	snapshot := &watchSnapshot{
+		fetched: time.Now(),
+		marks:   make(map[string]string),
+	}
+	metrics, err := store.List(ctx)
+	if err == nil {
+		snapshot.suppressions, err = store.Suppressions(ctx)
+	}
+	if err != nil {
+		// Keep showing the last metrics along with the error
+		if previous != nil {
+			snapshot.metrics = previous.metrics
+			snapshot.suppressions = previous.suppressions
+		}
+		snapshot.err = err
+		return snapshot
+	}
+	snapshot.metrics = metrics
+	if previous == nil {
+		return snapshot
+	}
+
+	before := make(map[string]backend.Metric)
+	for _, metric := range previous.metrics {
+		before[metric.Name] = metric
+	}
+	for _, metric := range metrics {
+		old, ok := before[metric.Name]
+		switch {
+		case !ok:
+			snapshot.marks[metric.Name] = markAdded
+		case old.Priority != metric.Priority || old.Colour != metric.Colour:
+			snapshot.marks[metric.Name] = markChanged
+		}
+		delete(before, metric.Name)
+	}
+	for _, metric := range previous.metrics {
+		if _, ok := before[metric.Name]; ok {
+			snapshot.removed = append(snapshot.removed, metric)
+			snapshot.marks[metric.Name] = markRemoved
+		}
+	}
+	return snapshot
+}
+
+// Render the watch view at now. Metrics which disappeared are listed after
+// the others.
+func renderSnapshot(w io.Writer, snapshot *watchSnapshot, interval time.Duration, now time.Time, opts listOptions) {
+	fmt.Fprintf(w, "Every %s: homemon metrics list  %s\n\n", interval, now.Format(time.DateTime))
+	if snapshot.err != nil {
+		fmt.Fprintf(w, "Error refreshing metrics at %s: %s\n\n", snapshot.fetched.Format(time.TimeOnly), snapshot.err)
+	}
+
+	views := make([]metricView, 0, len(snapshot.metrics)+len(snapshot.removed))
+	for _, metric := range snapshot.metrics {
+		views = append(views, newMetricView(metric, snapshot.suppressions, now))
+	}
+	sortViews(views, opts.sortBy, opts.reverse)
+	for _, metric := range snapshot.removed {
+		views = append(views, newMetricView(metric, snapshot.suppressions, now))
+	}
+	writeTable(w, views, opts, snapshot.marks)
+	writeSuppressions(w, snapshot.suppressions, now)
+}
+
+// Refresh the metrics every interval, redrawing the view every second so
+// that TTLs count down, until ctx is done
+func watchMetrics(ctx context.Context, w io.Writer, store backend.MetricStore, interval time.Duration, opts listOptions) {
+	snapshot := fetchSnapshot(ctx, store, nil)
+	draw := func() {
+		var buf bytes.Buffer
+		// Clear the screen and draw the whole view in one write to avoid
+		// flicker
+		buf.WriteString("\x1b[H\x1b[2J")
+		renderSnapshot(&buf, snapshot, interval, time.Now(), opts)
+		w.Write(buf.Bytes())
+	}
+	draw()
+
+	refreshTicker := time.NewTicker(interval)
+	defer refreshTicker.Stop()
+	drawTicker := time.NewTicker(time.Second)
+	defer drawTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-refreshTicker.C:
+			snapshot = fetchSnapshot(ctx, store, snapshot)
+			draw()
+		case <-drawTicker.C:
+			draw()
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/venkytv/homemon/backend"
+	"github.com/venkytv/homemon/netatmo"
+)
+
+//go:embed web
+var webAssets embed.FS
+
+// State of the dashboard as sent to the web UI
+type webState struct {
+	Time         time.Time             `json:"time"`
+	Live         bool                  `json:"live"`
+	Status       string                `json:"status,omitempty"`
+	Rooms        []webRoom             `json:"rooms"`
+	Metrics      []metricView          `json:"metrics"`
+	Suppressions []backend.Suppression `json:"suppressions"`
+}
+
+type webRoom struct {
+	Name     string       `json:"name"`
+	Readings []webReading `json:"readings"`
+}
+
+// Latest reading of a quantity in a room with its recent history and the
+// colour of its metric
+type webReading struct {
+	Key     string   `json:"key"`
+	Label   string   `json:"label"`
+	Unit    string   `json:"unit"`
+	Value   *float64 `json:"value,omitempty"`
+	Colour  string   `json:"colour,omitempty"`
+	History []point  `json:"history"`
+}
+
+// Snapshot of the dashboard at now for the web UI
+func (d *dashboard) webState(now time.Time) webState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	views := d.views(now)
+	byName := make(map[string]metricView)
+	for _, view := range views {
+		byName[view.Name] = view
+	}
+	state := webState{
+		Time:         now,
+		Live:         d.live,
+		Status:       d.status,
+		Metrics:      views,
+		Suppressions: d.suppressions,
+	}
+	for _, room := range d.rooms {
+		r := webRoom{Name: room}
+		for _, q := range d.quantities {
+			reading := webReading{Key: q.Key, Label: q.Label, Unit: q.Unit, History: []point{}}
+			metric, hasMetric := byName[netatmo.MetricName(q.Key, room)]
+			if s := d.readings[room][q.Key]; s != nil {
+				value := s.latest()
+				reading.Value = &value
+				reading.History = append(reading.History, s.points...)
+			} else if hasMetric {
+				reading.Value = metric.Value
+			}
+			if hasMetric {
+				reading.Colour = metric.Colour
+			}
+			r.Readings = append(r.Readings, reading)
+		}
+		state.Rooms = append(state.Rooms, r)
+	}
+	return state
+}
+
+// Serves the web UI and streams the dashboard state to it
+type webServer struct {
+	d *dashboard
+
+	mu      sync.Mutex
+	latest  []byte
+	clients map[chan []byte]struct{}
+}
+
+func newWebServer(d *dashboard) *webServer {
+	return &webServer{
+		d:       d,
+		clients: make(map[chan []byte]struct{}),
+	}
+}
+
+// Encode the current state and send it to every connected client
+func (s *webServer) broadcast() {
+	data, err := json.Marshal(s.d.webState(time.Now()))
+	if err != nil {
+		slog.Error("Error encoding dashboard state", "error", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latest = data
+	for client := range s.clients {
+		// Replace the previous state if the client has not read it yet
+		select {
+		case <-client:
+		default:
+		}
+		client <- data
+	}
+}
+
+func (s *webServer) handleState(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	data := s.latest
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// Stream the state as server-sent events, starting with the current state
+func (s *webServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	client := make(chan []byte, 1)
+	s.mu.Lock()
+	client <- s.latest
+	s.clients[client] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, client)
+		s.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case data := <-client:
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+		}
+	}
+}
+
+// Serve the web UI on address until ctx is done. The metrics are refreshed
+// every interval, and clients are updated after each refresh and each raw
+// reading.
+func serveWeb(ctx context.Context, d *dashboard, address string, interval time.Duration) error {
+	s := newWebServer(d)
+	d.refresh(ctx)
+	s.broadcast()
+
+	static, err := fs.Sub(webAssets, "web")
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.FS(static)))
+	mux.HandleFunc("/api/state", s.handleState)
+	mux.HandleFunc("/api/events", s.handleEvents)
+
+	server := &http.Server{
+		Addr:    address,
+		Handler: mux,
+		// End the event streams when ctx is done
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				server.Shutdown(shutdownCtx)
+				return
+			case <-d.updated:
+			case <-ticker.C:
+				d.refresh(ctx)
+			}
+			s.broadcast()
+		}
+	}()
+
+	slog.Info("Serving web dashboard", "address", address)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+"use strict";
+
+// Build an element with the given class and text
+function element(tag, className, text) {
+  const el = document.createElement(tag);
+  if (className) {
+    el.className = className;
+  }
+  if (text !== undefined) {
+    el.textContent = text;
+  }
+  return el;
+}
+
+function swatch(colour) {
+  const el = element("span", "swatch");
+  if (colour) {
+    el.style.background = colour;
+    el.title = colour;
+  }
+  return el;
+}
+
+function formatValue(value, unit) {
+  if (value === undefined || value === null) {
+    return "-";
+  }
+  const rounded = Number.isInteger(value) ? value : value.toFixed(1);
+  return unit ? `${rounded} ${unit}` : `${rounded}`;
+}
+
+// Line chart of the readings scaled between their minimum and maximum
+function chart(history) {
+  const ns = "http://www.w3.org/2000/svg";
+  const svg = document.createElementNS(ns, "svg");
+  svg.setAttribute("class", "chart");
+  svg.setAttribute("viewBox", "0 0 100 20");
+  svg.setAttribute("preserveAspectRatio", "none");
+  if (history.length < 2) {
+    return svg;
+  }
+  const values = history.map((p) => p.v);
+  const low = Math.min(...values);
+  const high = Math.max(...values);
+  const points = values.map((v, i) => {
+    const x = (i / (values.length - 1)) * 100;
+    const y = high > low ? 19 - ((v - low) / (high - low)) * 18 : 10;
+    return `${x.toFixed(2)},${y.toFixed(2)}`;
+  });
+  const line = document.createElementNS(ns, "polyline");
+  line.setAttribute("points", points.join(" "));
+  const title = document.createElementNS(ns, "title");
+  title.textContent = `${low} to ${high}`;
+  svg.append(title, line);
+  return svg;
+}
+
+function renderRooms(rooms) {
+  const section = document.getElementById("rooms");
+  section.replaceChildren(
+    ...rooms.map((room) => {
+      const card = element("article", "room");
+      card.append(element("h2", "", room.name));
+      for (const reading of room.readings) {
+        const row = element("div", "reading");
+        row.append(
+          swatch(reading.colour),
+          element("span", "label", reading.label),
+          chart(reading.history),
+          element("span", "value", formatValue(reading.value, reading.unit)),
+        );
+        card.append(row);
+      }
+      return card;
+    }),
+  );
+}
+
+function renderMetrics(metrics) {
+  const body = document.querySelector("#metrics tbody");
+  body.replaceChildren(
+    ...metrics.map((metric) => {
+      const row = element("tr");
+      const colour = element("td", "colour");
+      colour.append(swatch(metric.colour), metric.colour);
+      row.append(
+        element("td", "", metric.name),
+        element("td", "", metric.priority),
+        colour,
+        element("td", "", metric.ttl_remaining || "-"),
+        element("td", "", formatValue(metric.value, metric.unit)),
+        element("td", "", metric.updated || "-"),
+        element("td", "", metric.state || "-"),
+        element("td", "", metric.message || ""),
+      );
+      return row;
+    }),
+  );
+  document.getElementById("metrics").hidden = metrics.length === 0;
+  document.getElementById("no-metrics").hidden = metrics.length > 0;
+}
+
+function render(state) {
+  const time = new Date(state.time);
+  let updated = `Updated ${time.toLocaleTimeString()}`;
+  if (!state.live) {
+    updated += ", readings from metric values as NATS is not connected";
+  }
+  document.getElementById("updated").textContent = updated;
+  const status = document.getElementById("status");
+  status.textContent = state.status || "";
+  status.hidden = !state.status;
+  renderRooms(state.rooms);
+  renderMetrics(state.metrics);
+}
+
+function setConnection(text, online) {
+  const connection = document.getElementById("connection");
+  connection.textContent = text;
+  connection.classList.toggle("offline", !online);
+}
+
+// EventSource reconnects by itself after errors
+const events = new EventSource("api/events");
+events.onopen = () => setConnection("Live", true);
+events.onerror = () => setConnection("Reconnecting", false);
+events.onmessage = (event) => render(JSON.parse(event.data));